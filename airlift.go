@@ -0,0 +1,240 @@
+package hll
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// AirliftPPrime is the pPrime of sketches created by NewHllFromAirlift. It is the number of bits of
+// the bucket index of SPARSE_V2 entries.
+const AirliftPPrime = 26
+
+// The formats are implemented in SparseHll.java and DenseHll.java.
+// See: https://github.com/airlift/airlift/tree/master/stats/src/main/java/io/airlift/stats/cardinality
+const (
+	airliftSparseV1 = 0
+	airliftDenseV1  = 1
+	airliftSparseV2 = 2
+	airliftDenseV2  = 3
+
+	airliftValueBits = 6
+	airliftValueMask = 1<<airliftValueBits - 1
+	airliftMaxDelta  = 15
+
+	// airlift supports between 2 and 65536 buckets.
+	airliftMaxP = 16
+)
+
+// AirliftHash hashes a string the same way as HyperLogLog.add(Slice) in airlift.
+func AirliftHash(s string) uint64 {
+	return AirliftHashBytes([]byte(s))
+}
+
+// AirliftHashBytes is the same as AirliftHash but for a byte slice.
+func AirliftHashBytes(b []byte) uint64 {
+	h, _ := murmur3Sum128(b, 0)
+	return h
+}
+
+// AirliftHashInt64 hashes an int64 the same way as HyperLogLog.add(long) in airlift.
+func AirliftHashInt64(v int64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	return AirliftHashBytes(b[:])
+}
+
+// NewHllFromAirlift decodes an airlift HyperLogLog in the SPARSE_V2 or DENSE_V2 format. This is the
+// format Trino and Presto use for the HyperLogLog type, for example the result of approx_set cast
+// to varbinary. The resulting Hll has p equal to the index bit length and pPrime AirliftPPrime.
+//
+// airlift uses the same bits of the hash for the index and rhoW, so the registers are the same as
+// when adding the hashes to an Hll directly. The Hll uses Murmur3Hasher, the hash function of airlift.
+func NewHllFromAirlift(data []byte) (*Hll, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: sketch too short", ErrMalformed)
+	}
+
+	switch data[0] {
+	case airliftSparseV2, airliftDenseV2:
+	case airliftSparseV1, airliftDenseV1:
+		return nil, fmt.Errorf("%w: format %d", ErrUnsupportedVersion, data[0])
+	default:
+		return nil, fmt.Errorf("%w: format %d", ErrUnsupportedType, data[0])
+	}
+
+	p := uint(data[1])
+	if p < 4 || p > airliftMaxP {
+		return nil, fmt.Errorf("%w: index bit length %d", ErrBadPrecision, p)
+	}
+
+	h := NewHll(p, AirliftPPrime)
+	h.hasher = Murmur3Hasher
+	if data[0] == airliftSparseV2 {
+		return h, h.setAirliftSparse(data[2:])
+	}
+	return h, h.setAirliftDense(data[2:])
+}
+
+// setAirliftSparse decodes the SPARSE_V2 entries. Every entry is a 26 bit bucket index followed by
+// the number of leading zeros in the remaining 38 bits of the hash.
+func (h *Hll) setAirliftSparse(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("%w: missing number of entries", ErrCorruptSparse)
+	}
+
+	n := int(binary.LittleEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != n*4 {
+		return fmt.Errorf("%w: expected %d bytes for %d entries, got %d", ErrCorruptSparse, n*4, n, len(data))
+	}
+
+	for i := 0; i < n; i++ {
+		entry := binary.LittleEndian.Uint32(data[i*4:])
+		bucket, zeros := uint64(entry>>airliftValueBits), uint8(entry&airliftValueMask)
+		if zeros > 64-AirliftPPrime {
+			return fmt.Errorf("%w: invalid entry %#x", ErrCorruptSparse, entry)
+		}
+		h.addHash(bucket<<(64-AirliftPPrime) | rhoWToBits(zeros+1, 64-AirliftPPrime))
+	}
+
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+// setAirliftDense decodes the DENSE_V2 registers. Registers are stored as 4 bit deltas from a
+// baseline, registers with the maximum delta can have an additional overflow.
+func (h *Hll) setAirliftDense(data []byte) error {
+	if uint64(len(data)) < 1+h.m/2+2 {
+		return fmt.Errorf("%w: sketch too short", ErrCorruptDense)
+	}
+
+	baseline := data[0]
+	deltas := data[1 : 1+h.m/2]
+	data = data[1+h.m/2:]
+
+	n := int(binary.LittleEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != n*3 {
+		return fmt.Errorf("%w: expected %d bytes for %d overflows, got %d", ErrCorruptDense, n*3, n, len(data))
+	}
+
+	overflows := make(map[uint64]uint8, n)
+	for i := 0; i < n; i++ {
+		bucket := uint64(binary.LittleEndian.Uint16(data[i*2:]))
+		if bucket >= h.m {
+			return fmt.Errorf("%w: overflow for bucket %d", ErrCorruptDense, bucket)
+		}
+		overflows[bucket] = data[n*2+i]
+	}
+
+	maxRhoW := 64 - h.p + 1
+	h.switchToNormal()
+
+	for i := uint64(0); i < h.m; i++ {
+		// Even buckets are stored in the high nibble.
+		delta := uint(deltas[i/2]>>(4*(1-i&1))) & 0xf
+		if delta == airliftMaxDelta {
+			delta += uint(overflows[i])
+		}
+
+		r := uint(baseline) + delta
+		if r > maxRhoW {
+			return fmt.Errorf("%w: bucket %d has value %d", ErrCorruptDense, i, r)
+		}
+		h.bigM.Set(i, uint8(r))
+	}
+	return nil
+}
+
+// MarshalAirlift encodes the Hll as an airlift HyperLogLog so it can be used as a Trino or Presto
+// HyperLogLog. Sparse sketches are encoded as SPARSE_V2 while that is smaller than DENSE_V2.
+//
+// airlift supports at most 65536 buckets, an Hll with a p above 16 is downsampled first. A sparse
+// Hll with a pPrime below AirliftPPrime results in the same registers, but the bucket index of the
+// SPARSE_V2 entries is only accurate up to pPrime bits.
+func (h *Hll) MarshalAirlift() ([]byte, error) {
+	d := h
+	if h.p > airliftMaxP {
+		var err error
+		if d, err = h.Downsample(airliftMaxP, h.pPrime); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mergeTmpSetIfAny()
+
+	if d.isSparse {
+		if data, ok := d.airliftSparse(); ok {
+			return data, nil
+		}
+	}
+
+	registers := d.bigM
+	if d.isSparse {
+		registers = toNormal(d.sparseList, d.p, d.pPrime)
+	}
+
+	baseline := uint8(math.MaxUint8)
+	for i := uint64(0); i < d.m; i++ {
+		baseline = minU8(baseline, registers.Get(i))
+	}
+
+	data := make([]byte, 3+d.m/2+2)
+	data[0], data[1], data[2] = airliftDenseV2, byte(d.p), baseline
+
+	var buckets, values []byte
+	for i := uint64(0); i < d.m; i++ {
+		delta := registers.Get(i) - baseline
+		if delta > airliftMaxDelta {
+			buckets = append(buckets, byte(i), byte(i>>8))
+			values = append(values, delta-airliftMaxDelta)
+			delta = airliftMaxDelta
+		}
+		data[3+i/2] |= delta << (4 * (1 - i&1))
+	}
+
+	binary.LittleEndian.PutUint16(data[3+d.m/2:], uint16(len(values)))
+	return append(append(data, buckets...), values...), nil
+}
+
+// airliftSparse returns the SPARSE_V2 encoding of a sparse Hll. It returns false if the dense
+// encoding is smaller or there are too many entries.
+func (h *Hll) airliftSparse() ([]byte, bool) {
+	data := []byte{airliftSparseV2, byte(h.p), 0, 0}
+
+	n := 0
+	it := h.sparseList.GetIterator()
+	for {
+		k, ok := it()
+		if !ok {
+			break
+		}
+
+		x := decodeSparseHashToHash(k, h.p, h.pPrime)
+		entry := uint32(x>>(64-AirliftPPrime))<<airliftValueBits | uint32(computeRhoW(x, 64-AirliftPPrime)-1)
+
+		// The sparse list is ordered by index, so with a pPrime above AirliftPPrime elements for the
+		// same bucket are next to each other.
+		if n > 0 {
+			last := binary.LittleEndian.Uint32(data[len(data)-4:])
+			if last>>airliftValueBits == entry>>airliftValueBits {
+				if entry > last {
+					binary.LittleEndian.PutUint32(data[len(data)-4:], entry)
+				}
+				continue
+			}
+		}
+
+		data = append(data, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(data[len(data)-4:], entry)
+		n++
+
+		if n > math.MaxInt16 || uint64(len(data)) > 5+h.m/2 {
+			return nil, false
+		}
+	}
+
+	binary.LittleEndian.PutUint16(data[2:], uint16(n))
+	return data, true
+}
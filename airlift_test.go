@@ -0,0 +1,127 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestAirlift_Sparse(t *testing.T) {
+	// p 12 with two entries: bucket 0 with 37 leading zeros and bucket 0x3ffffff with 0.
+	data := []byte{2, 12, 2, 0, 0x25, 0, 0, 0, 0xc0, 0xff, 0xff, 0xff}
+
+	h, err := NewHllFromAirlift(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.p != 12 || h.pPrime != AirliftPPrime {
+		t.Errorf("expected p 12 and pPrime %d got %d and %d", AirliftPPrime, h.p, h.pPrime)
+	}
+
+	// Bucket 0 is register 0 with 14 zeros after the index plus the 37 in the entry.
+	M := registers(h)
+	if M.Get(0) != 52 || M.Get(4095) != 1 {
+		t.Errorf("expected registers 52 and 1 got %d and %d", M.Get(0), M.Get(4095))
+	}
+
+	out, err := h.MarshalAirlift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("expected %x got %x", data, out)
+	}
+}
+
+func TestAirlift_Dense(t *testing.T) {
+	// p 4 with baseline 2 and an overflow of 3 for bucket 5.
+	data := []byte{3, 4, 2, 0x01, 0x23, 0x4f, 0x00, 0, 0, 0, 0xf0, 1, 0, 5, 0, 3}
+
+	h, err := NewHllFromAirlift(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint8{2, 3, 4, 5, 6, 20, 2, 2, 2, 2, 2, 2, 2, 2, 17, 2}
+	M := registers(h)
+	for i, r := range expected {
+		if got := M.Get(uint64(i)); got != r {
+			t.Errorf("register %d: expected %d got %d", i, r, got)
+		}
+	}
+
+	out, err := h.MarshalAirlift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("expected %x got %x", data, out)
+	}
+}
+
+func TestAirlift_RoundTrip(t *testing.T) {
+	for _, p := range []uint{4, 12, 16, 18} {
+		for _, pPrime := range []uint{20, 25, 26, 30} {
+			for _, n := range []int{0, 10, 1000, 100000} {
+				t.Run(fmt.Sprintf("p%d-%d-%d", p, pPrime, n), func(t *testing.T) {
+					h := NewHll(p, pPrime)
+					for i := 0; i < n; i++ {
+						h.Add(AirliftHashInt64(rand.Int63()))
+					}
+
+					data, err := h.MarshalAirlift()
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					h2, err := NewHllFromAirlift(data)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					expected := h
+					if p > airliftMaxP {
+						if expected, err = h.Downsample(airliftMaxP, pPrime); err != nil {
+							t.Fatal(err)
+						}
+					}
+
+					M, M2 := registers(expected), registers(h2)
+					for i := uint64(0); i < expected.m; i++ {
+						if M.Get(i) != M2.Get(i) {
+							t.Fatalf("register %d: expected %d got %d", i, M.Get(i), M2.Get(i))
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAirlift_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short", []byte{2}, ErrMalformed},
+		{"v1", []byte{1, 12}, ErrUnsupportedVersion},
+		{"format", []byte{4, 12}, ErrUnsupportedType},
+		{"p", []byte{2, 17, 0, 0}, ErrBadPrecision},
+		{"sparse count", []byte{2, 12, 2, 0, 0, 0, 0, 0}, ErrCorruptSparse},
+		{"sparse value", []byte{2, 12, 1, 0, 0x3f, 0, 0, 0}, ErrCorruptSparse},
+		{"dense short", []byte{3, 4, 0, 0}, ErrCorruptDense},
+		{"dense overflow", []byte{3, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 16, 0, 1}, ErrCorruptDense},
+		{"dense value", []byte{3, 4, 61, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0}, ErrCorruptDense},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewHllFromAirlift(test.data); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+}
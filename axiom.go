@@ -0,0 +1,184 @@
+package hll
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// AxiomPPrime is the sparse precision of github.com/axiomhq/hyperloglog. Sketches created by
+// NewHllFromAxiom use it as pPrime.
+const AxiomPPrime = 25
+
+// The format is implemented in hyperloglog.go, sparse.go and compressed.go.
+// See: https://github.com/axiomhq/hyperloglog/blob/v0.2.5/hyperloglog.go
+const (
+	axiomHeaderSize = 8
+
+	axiomTailcut = 1 // Version 1 stores dense registers as 4 bit values relative to a base.
+	axiomDense   = 2 // Version 2 stores dense registers as bytes.
+
+	axiomMaxTailcut = 15
+)
+
+// NewHllFromAxiom decodes a sketch serialized with MarshalBinary of github.com/axiomhq/hyperloglog.
+// Both version 1 with tailcut registers and version 2 are supported, sparse or dense. The resulting
+// Hll has the same p and pPrime AxiomPPrime.
+//
+// Version 1 capped registers at 15 above the lowest register. exact is false if any register was at
+// that maximum, its real value might have been higher. The sparse representation and version 2
+// registers are always converted exactly.
+//
+// The registers are the same as when the hashes were added to the Hll directly, so hashes that
+// were passed to InsertHash can be added with Add. Insert hashes values with metro hash and a seed
+// of 1337.
+func NewHllFromAxiom(data []byte) (h *Hll, exact bool, err error) {
+	if len(data) < axiomHeaderSize {
+		return nil, false, fmt.Errorf("%w: sketch too short", ErrMalformed)
+	}
+
+	version, p, b, sparse := data[0], uint(data[1]), data[2], data[3]
+	if version != axiomTailcut && version != axiomDense {
+		return nil, false, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	if p < 4 || p > 18 {
+		return nil, false, fmt.Errorf("%w: %d", ErrBadPrecision, p)
+	}
+
+	h = NewHll(p, AxiomPPrime)
+
+	switch {
+	case sparse == 1:
+		return h, true, h.setAxiomSparse(data[4:])
+	case version == axiomTailcut:
+		exact, err = h.setAxiomTailcut(data[4:], b)
+		return h, exact, err
+	default:
+		return h, true, h.setAxiomDense(data[4:])
+	}
+}
+
+// setAxiomSparse decodes the temporary set followed by the compressed list. Both contain elements
+// encoded by encodeHash, the compressed list stores them as differences with varints.
+func (h *Hll) setAxiomSparse(data []byte) error {
+	n := uint64(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if uint64(len(data)) < n*4+12 {
+		return fmt.Errorf("%w: %d temporary elements don't fit", ErrCorruptSparse, n)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		x, err := h.axiomSparseHash(binary.BigEndian.Uint32(data[i*4:]))
+		if err != nil {
+			return err
+		}
+		h.addHash(x)
+	}
+	data = data[n*4:]
+
+	count := binary.BigEndian.Uint32(data)
+	size := uint64(binary.BigEndian.Uint32(data[8:]))
+	data = data[12:]
+	if uint64(len(data)) != size {
+		return fmt.Errorf("%w: expected %d bytes of elements, got %d", ErrCorruptSparse, size, len(data))
+	}
+
+	var k uint32
+	for i := uint32(0); len(data) > 0; i++ {
+		delta, n := axiomVarint(data)
+		if n == 0 || i == count {
+			return fmt.Errorf("%w: invalid compressed list", ErrCorruptSparse)
+		}
+		data = data[n:]
+
+		k += delta
+		x, err := h.axiomSparseHash(k)
+		if err != nil {
+			return err
+		}
+		h.addHash(x)
+	}
+
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+// axiomSparseHash returns a hash that results in the sparse element k. The lowest bit of k is set
+// if the bits of the index after p are zero, in which case the next 6 bits are the rhoW of the hash
+// after the index.
+func (h *Hll) axiomSparseHash(k uint32) (uint64, error) {
+	const bts = 64 - AxiomPPrime
+
+	mask := uint64(1)<<(AxiomPPrime-h.p) - 1
+
+	if k&1 == 0 {
+		idx := uint64(k >> 1)
+		if idx&mask == 0 {
+			return 0, fmt.Errorf("%w: invalid element %#x", ErrCorruptSparse, k)
+		}
+		return idx << bts, nil
+	}
+
+	idx, r := uint64(k>>7), uint8(k>>1&0x3f)
+	if idx&mask != 0 || r < 1 || r > bts+1 {
+		return 0, fmt.Errorf("%w: invalid element %#x", ErrCorruptSparse, k)
+	}
+	return idx<<bts | rhoWToBits(r, bts), nil
+}
+
+// axiomVarint decodes a little endian base 128 varint. It returns 0 bytes read if data ends before
+// the varint does or the value doesn't fit in 32 bits.
+func axiomVarint(data []byte) (uint32, int) {
+	var x uint32
+	for i, b := range data {
+		if i == 5 {
+			return 0, 0
+		}
+		x |= uint32(b&0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			return x, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func (h *Hll) setAxiomDense(data []byte) error {
+	if size := uint64(binary.BigEndian.Uint32(data)); size != h.m || uint64(len(data)) != 4+h.m {
+		return fmt.Errorf("%w: expected %d registers", ErrCorruptDense, h.m)
+	}
+
+	maxRhoW := uint8(64 - h.p + 1)
+	h.switchToNormal()
+
+	for i, r := range data[4:] {
+		if r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+		h.bigM.Set(uint64(i), r)
+	}
+	return nil
+}
+
+func (h *Hll) setAxiomTailcut(data []byte, b uint8) (bool, error) {
+	if size := uint64(binary.BigEndian.Uint32(data)); size != h.m/2 || uint64(len(data)) != 4+h.m/2 {
+		return false, fmt.Errorf("%w: expected %d bytes of registers", ErrCorruptDense, h.m/2)
+	}
+
+	maxRhoW := uint8(64 - h.p + 1)
+	exact := true
+	h.switchToNormal()
+
+	for i := uint64(0); i < h.m; i++ {
+		// Even registers are stored in the high nibble.
+		v := data[4+i/2] >> (4 * (1 - i&1)) & 0xf
+		if v == axiomMaxTailcut {
+			exact = false
+		}
+
+		r := uint(v) + uint(b)
+		if r > uint(maxRhoW) {
+			return false, fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+		h.bigM.Set(i, uint8(r))
+	}
+	return exact, nil
+}
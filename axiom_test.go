@@ -0,0 +1,105 @@
+package hll
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestAxiom(t *testing.T) {
+	// Generated with github.com/axiomhq/hyperloglog v0.2.5 by calling InsertHash with these hashes.
+	hashes := []uint64{0x2ceaee21bf46bc00, 0xaa80754d1a1a8d4f, 0xb3c4904a6d278932, 0xabc0000000001234}
+
+	tests := []struct {
+		name string
+		p    uint
+		data string
+	}{
+		{"sparse tmp", 14, "020e00010000000402aa01d400b3abb802cf1240abc00037000000000000000000000000"},
+		{"sparse list", 14, "020e00010000000000000004abc0003700000011b8d7ce059cacd90feca09401f7dbc3c70a"},
+		{"dense", 4, "020400000000001000000100000000000000010300000000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.data)
+
+			h, exact, err := NewHllFromAxiom(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !exact {
+				t.Errorf("expected an exact conversion")
+			}
+
+			expected := NewHll(test.p, AxiomPPrime)
+			for _, x := range hashes {
+				expected.Add(x)
+			}
+
+			if h.Cardinality() != expected.Cardinality() {
+				t.Errorf("expected cardinality %d got %d", expected.Cardinality(), h.Cardinality())
+			}
+
+			M, M2 := registers(expected), registers(h)
+			for i := uint64(0); i < expected.m; i++ {
+				if M.Get(i) != M2.Get(i) {
+					t.Fatalf("register %d: expected %d got %d", i, M.Get(i), M2.Get(i))
+				}
+			}
+		})
+	}
+}
+
+func TestAxiom_Tailcut(t *testing.T) {
+	// Version 1 with p 4 and base 2. Register 0 is 2, register 1 is 17 which might have been cut.
+	data := []byte{1, 4, 2, 0, 0, 0, 0, 8, 0x0f, 0x10, 0, 0, 0, 0, 0, 0x01}
+
+	h, exact, err := NewHllFromAxiom(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exact {
+		t.Errorf("expected an inexact conversion")
+	}
+
+	expected := []uint8{2, 17, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3}
+	M := registers(h)
+	for i, r := range expected {
+		if got := M.Get(uint64(i)); got != r {
+			t.Errorf("register %d: expected %d got %d", i, r, got)
+		}
+	}
+
+	data[8] = 0x0e
+	if _, exact, err := NewHllFromAxiom(data); err != nil || !exact {
+		t.Errorf("expected an exact conversion got %v %v", exact, err)
+	}
+}
+
+func TestAxiom_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"short", "020e0001", ErrMalformed},
+		{"version", "030e000100000000", ErrUnsupportedVersion},
+		{"p", "0213000100000000", ErrBadPrecision},
+		{"tmp set", "020e00010000000402aa01d4", ErrCorruptSparse},
+		{"tmp element", "020e00010000000100000000000000000000000000000000", ErrCorruptSparse},
+		{"list size", "020e00010000000000000001abc000370000000501", ErrCorruptSparse},
+		{"list count", "020e00010000000000000001abc0003700000002b8d7", ErrCorruptSparse},
+		{"dense size", "020400000000000f00", ErrCorruptDense},
+		{"dense value", "020400000000001000000100000000000000010300000040", ErrCorruptDense},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(test.data)
+			if _, _, err := NewHllFromAxiom(data); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+}
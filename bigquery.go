@@ -3,8 +3,8 @@ package hll
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 	"math/bits"
+	"sort"
 
 	"github.com/golang/protobuf/proto"
 )
@@ -12,164 +12,356 @@ import (
 const DefaultBigqueryP = 15
 const DefaultBigqueryPPrime = 20
 
-func getField(buf *proto.Buffer) (uint64, uint64, error) {
-	x, err := buf.DecodeVarint()
+// The BigQuery HLL_COUNT functions store sketches as a ZetaSketch AggregatorStateProto with a
+// HyperLogLogPlusUniqueStateProto as extension.
+// See: https://github.com/google/zetasketch/blob/a2f2692fae8cf61103330f9f70e696c4ba8b94b0/proto/google/protos/zetasketch/aggregator.proto
+const (
+	bigqueryType            = 112 // AggregatorType.HYPERLOGLOG_PLUS_UNIQUE
+	bigqueryEncodingVersion = 2
+)
+
+// wireReader reads protobuf wire format fields from a buffer. It never reads outside of the buffer
+// and never allocates.
+type wireReader struct {
+	buf []byte
+}
+
+func (r *wireReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: bad varint", ErrMalformed)
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *wireReader) field() (field, wireType uint64, err error) {
+	x, err := r.varint()
 	if err != nil {
 		return 0, 0, err
 	}
-	f := x >> 3 & 0b111
-	t := x & 0b111
-	return f, t, nil
+	field, wireType = x>>3, x&0b111
+	if field == 0 {
+		return 0, 0, fmt.Errorf("%w: field number 0", ErrMalformed)
+	}
+	return field, wireType, nil
+}
+
+// value reads a varint for a field that was read with wire type t.
+func (r *wireReader) value(field, t uint64) (uint64, error) {
+	if t != proto.WireVarint {
+		return 0, fmt.Errorf("%w: unexpected wire type %d for field %d", ErrMalformed, t, field)
+	}
+	return r.varint()
 }
 
+// bytes reads a length delimited field that was read with wire type t. The result points into the
+// buffer.
+func (r *wireReader) bytes(field, t uint64) ([]byte, error) {
+	if t != proto.WireBytes {
+		return nil, fmt.Errorf("%w: unexpected wire type %d for field %d", ErrMalformed, t, field)
+	}
+	l, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(len(r.buf)) {
+		return nil, fmt.Errorf("%w: field %d is truncated", ErrMalformed, field)
+	}
+	b := r.buf[:l]
+	r.buf = r.buf[l:]
+	return b, nil
+}
+
+// skip skips an unknown field that was read with wire type t.
+func (r *wireReader) skip(field, t uint64) error {
+	var n uint64
+	switch t {
+	case proto.WireVarint:
+		_, err := r.varint()
+		return err
+	case proto.WireBytes:
+		_, err := r.bytes(field, t)
+		return err
+	case proto.WireFixed64:
+		n = 8
+	case proto.WireFixed32:
+		n = 4
+	default:
+		return fmt.Errorf("%w: unsupported wire type %d for field %d", ErrMalformed, t, field)
+	}
+	if n > uint64(len(r.buf)) {
+		return fmt.Errorf("%w: field %d is truncated", ErrMalformed, field)
+	}
+	r.buf = r.buf[n:]
+	return nil
+}
+
+// bigqueryState holds the fields of a ZetaSketch AggregatorStateProto and its
+// HyperLogLogPlusUniqueStateProto extension that we use.
+type bigqueryState struct {
+	typ, numValues, encodingVersion, valueType uint64
+	sparseSize, precision, sparsePrecision     uint64
+	normalData, sparseData                     []byte
+}
+
+func (s *bigqueryState) parse(data []byte) error {
+	r := wireReader{data}
+	for len(r.buf) > 0 {
+		f, t, err := r.field()
+		if err != nil {
+			return err
+		}
+
+		switch f {
+		case 1:
+			s.typ, err = r.value(f, t)
+		case 2:
+			s.numValues, err = r.value(f, t)
+		case 3:
+			s.encodingVersion, err = r.value(f, t)
+		case 4:
+			s.valueType, err = r.value(f, t)
+		case bigqueryType:
+			var state []byte
+			if state, err = r.bytes(f, t); err == nil {
+				err = s.parseHllState(state)
+			}
+		default:
+			err = r.skip(f, t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *bigqueryState) parseHllState(data []byte) error {
+	r := wireReader{data}
+	for len(r.buf) > 0 {
+		f, t, err := r.field()
+		if err != nil {
+			return err
+		}
+
+		switch f {
+		case 2:
+			s.sparseSize, err = r.value(f, t)
+		case 3:
+			s.precision, err = r.value(f, t)
+		case 4:
+			s.sparsePrecision, err = r.value(f, t)
+		case 5:
+			s.normalData, err = r.bytes(f, t)
+		case 6:
+			s.sparseData, err = r.bytes(f, t)
+		default:
+			err = r.skip(f, t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewHllFromBigquery decodes a sketch produced by BigQuery's HLL_COUNT.INIT. The input is fully
+// validated, errors wrap one of the Err variables so they can be checked with errors.Is. Only
+// precisions supported by NewHll can be decoded. The Hll uses ZetaSketchHasher.
 func NewHllFromBigquery(data []byte) (*Hll, error) {
 	if len(data) == 0 {
 		return NewHll(DefaultBigqueryP, DefaultBigqueryPPrime), nil
 	}
 
-	var typ, numValues, encodingVersion, valueType, sparseSize, precision, sparsePrecision uint64
-	var normalData, sparseData []byte
+	var s bigqueryState
+	if err := s.parse(data); err != nil {
+		return nil, err
+	}
 
-	buf := proto.NewBuffer(data)
+	if s.typ != bigqueryType {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedType, s.typ)
+	}
+	if s.encodingVersion != bigqueryEncodingVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, s.encodingVersion)
+	}
+	if s.precision < 4 || s.precision > 18 {
+		return nil, fmt.Errorf("%w: precision %d", ErrBadPrecision, s.precision)
+	}
+	if s.sparsePrecision == 0 && len(s.sparseData) == 0 {
+		// ZetaSketch uses a sparse precision of 0 to disable the sparse representation.
+		s.sparsePrecision = s.precision
+	}
+	if s.sparsePrecision < s.precision || s.sparsePrecision > 25 {
+		return nil, fmt.Errorf("%w: sparse precision %d", ErrBadPrecision, s.sparsePrecision)
+	}
+	if len(s.normalData) > 0 && len(s.sparseData) > 0 {
+		return nil, fmt.Errorf("%w: can not have both normal and sparse data", ErrMalformed)
+	}
 
-	for len(data) > 0 {
-		f, t, err := getField(buf)
-		if err == io.ErrUnexpectedEOF {
-			break
-		} else if err != nil {
+	h := NewHll(uint(s.precision), uint(s.sparsePrecision))
+	if len(s.normalData) > 0 {
+		if err := h.setBigqueryNormal(s.normalData); err != nil {
 			return nil, err
 		}
+	} else if err := h.setBigquerySparse(s.sparseData, s.sparseSize); err != nil {
+		return nil, err
+	}
 
-		if f == 1 {
-			if t != 0 {
-				return nil, fmt.Errorf("unexpected type: %d", t)
-			}
-			typ, err = buf.DecodeVarint()
-			if err != nil {
-				return nil, err
-			}
-		} else if f == 2 {
-			if t != 0 {
-				return nil, fmt.Errorf("unexpected type: %d", t)
-			}
-			numValues, err = buf.DecodeVarint()
-			if err != nil {
-				return nil, err
-			}
-		} else if f == 3 {
-			if t != 0 {
-				return nil, fmt.Errorf("unexpected type: %d", t)
-			}
-			encodingVersion, err = buf.DecodeVarint()
-			if err != nil {
-				return nil, err
-			}
-		} else if f == 4 {
-			if t != 0 {
-				return nil, fmt.Errorf("unexpected type: %d", t)
-			}
-			valueType, err = buf.DecodeVarint()
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			_, err := buf.DecodeVarint() // ignore size
-			if err != nil {
-				return nil, err
-			}
+	h.numValues = s.numValues
 
-			for len(data) > 0 {
-				f, t, err := getField(buf)
-				if err == io.ErrUnexpectedEOF {
-					break
-				} else if err != nil {
-					return nil, err
-				}
-
-				if f == 2 { // SPARSE_SIZE_TAG
-					if t != 0 {
-						return nil, fmt.Errorf("unexpected type: %d", t)
-					}
-					sparseSize, err = buf.DecodeVarint()
-					if err != nil {
-						return nil, err
-					}
-				} else if f == 3 {
-					if t != 0 {
-						return nil, fmt.Errorf("unexpected type: %d", t)
-					}
-					precision, err = buf.DecodeVarint()
-					if err != nil {
-						return nil, err
-					}
-				} else if f == 4 {
-					if t != 0 {
-						return nil, fmt.Errorf("unexpected type: %d", t)
-					}
-					sparsePrecision, err = buf.DecodeVarint()
-					if err != nil {
-						return nil, err
-					}
-				} else if f == 5 {
-					normalData, err = buf.DecodeRawBytes(true)
-					if err != nil {
-						return nil, err
-					}
-				} else if f == 6 {
-					sparseData, err = buf.DecodeRawBytes(true)
-					if err != nil {
-						return nil, err
-					}
-				} else {
-					fmt.Println(f, t)
-
-					break
-				}
-			}
+	// valueType is the type of data that was put into the aggregator.
+	// See: https://github.com/google/zetasketch/blob/a2f2692fae8cf61103330f9f70e696c4ba8b94b0/java/com/google/zetasketch/HyperLogLogPlusPlus.java#L442-L459
+	h.valueType = ValueType(int32(s.valueType))
+	h.hasher = ZetaSketchHasher
 
-			break
-		}
+	return h, nil
+}
+
+func (h *Hll) setBigqueryNormal(data []byte) error {
+	if uint64(len(data)) != h.m {
+		return fmt.Errorf("%w: expected %d registers, got %d", ErrCorruptDense, h.m, len(data))
 	}
 
-	if typ != 112 {
-		return nil, fmt.Errorf("unexpected type: %d", typ)
+	maxRhoW := uint8(64 - h.p + 1)
+
+	h.switchToNormal()
+	for idx, r := range data {
+		if r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, idx, r)
+		}
+		h.bigM.Set(uint64(idx), r)
 	}
-	if encodingVersion != 2 {
-		return nil, fmt.Errorf("unsupported encodingVersion: %d", encodingVersion)
+	return nil
+}
+
+// setBigquerySparse decodes ZetaSketch sparse data. ZetaSketch orders the values by their encoded
+// value, our sparse list is ordered by index, so the values are sorted and merged like the temp set.
+func (h *Hll) setBigquerySparse(data []byte, size uint64) error {
+	// Every value takes at least one byte, this bounds the allocation below by the input size.
+	if size > uint64(len(data)) {
+		return fmt.Errorf("%w: %d values don't fit in %d bytes", ErrCorruptSparse, size, len(data))
 	}
 
-	h := NewHll(uint(precision), uint(sparsePrecision))
-	if len(normalData) > 0 {
-		if len(sparseData) > 0 {
-			return nil, fmt.Errorf("cna not have both normal and sparse data")
+	values := make([]uint64, 0, size)
+	r := wireReader{data}
+	var k uint64
+	for len(r.buf) > 0 {
+		delta, err := r.varint()
+		if err != nil {
+			return fmt.Errorf("%w: bad varint", ErrCorruptSparse)
 		}
-
-		h.switchToNormal()
-		for idx, r := range normalData {
-			h.bigM.Set(uint64(idx), r)
+		k += delta
+		if !validSparseHash(k, h.p, h.pPrime) {
+			return fmt.Errorf("%w: invalid value %d", ErrCorruptSparse, k)
+		}
+		if uint64(len(values)) == size {
+			return fmt.Errorf("%w: more than %d values", ErrCorruptSparse, size)
 		}
+		values = append(values, k)
+	}
+	if uint64(len(values)) != size {
+		return fmt.Errorf("%w: expected %d values, got %d", ErrCorruptSparse, size, len(values))
+	}
+
+	h.tempSet = values
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+// MarshalBigquery encodes the Hll in the format produced by BigQuery's HLL_COUNT.INIT so it can be
+// loaded back into BigQuery and passed to HLL_COUNT.MERGE or HLL_COUNT.EXTRACT. It is the inverse of
+// NewHllFromBigquery. Values should have been added using BigQueryHash (or one of the typed
+// variants together with SetValueType) for the result to be mergeable with sketches created by
+// BigQuery.
+func (h *Hll) MarshalBigquery() ([]byte, error) {
+	// These are the limits ZetaSketch enforces when reading a sketch.
+	if h.p < 10 || h.p > 24 {
+		return nil, fmt.Errorf("precision %d not supported by BigQuery", h.p)
+	}
+	if h.pPrime < h.p || h.pPrime > 25 {
+		return nil, fmt.Errorf("sparse precision %d not supported by BigQuery", h.pPrime)
+	}
+
+	h.mergeTmpSetIfAny()
+
+	var state []byte
+	if h.isSparse {
+		state = h.bigquerySparseState()
 	} else {
-		h.sparseList.buf = sparseData
-		h.sparseList.numElements = sparseSize
-
-		it := h.sparseList.GetIterator()
-		for {
-			last, ok := it()
-			if !ok {
-				break
-			}
-			h.sparseList.lastVal = last
+		state = h.bigqueryNormalState()
+	}
+
+	// Sketches without a value type are assumed to contain strings hashed with BigQueryHash.
+	valueType := h.valueType
+	if valueType == ValueTypeUnknown {
+		valueType = ValueTypeBytesOrString
+	}
+
+	buf := proto.NewBuffer(nil)
+	putBigqueryVarint(buf, 1, bigqueryType)
+	putBigqueryVarint(buf, 2, h.numValues)
+	putBigqueryVarint(buf, 3, bigqueryEncodingVersion)
+	putBigqueryVarint(buf, 4, uint64(valueType))
+	putBigqueryBytes(buf, bigqueryType, state)
+
+	return buf.Bytes(), nil
+}
+
+// bigquerySparseState returns the HyperLogLogPlusUniqueStateProto for a sparse Hll. Our sparse
+// list uses the same encoding as ZetaSketch, but it is ordered by index while ZetaSketch difference
+// encodes the values in ascending order. These differ when values with rhoW encoded are present.
+func (h *Hll) bigquerySparseState() []byte {
+	values := make([]uint64, 0, h.sparseList.numElements)
+	it := h.sparseList.GetIterator()
+	for {
+		k, ok := it()
+		if !ok {
+			break
 		}
+		values = append(values, k)
 	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
 
-	// We ignore the number of values the aggregator has seen as we don't keep track of this.
-	_ = numValues
+	data := newSparse(h.sparseList.SizeInBytes())
+	for _, k := range values {
+		data.Add(k)
+	}
 
-	// We ignore valueType, it is the type of data that was put into the aggregator.
-	// See: https://github.com/google/zetasketch/blob/a2f2692fae8cf61103330f9f70e696c4ba8b94b0/java/com/google/zetasketch/HyperLogLogPlusPlus.java#L442-L459
-	_ = valueType
+	buf := proto.NewBuffer(nil)
+	putBigqueryVarint(buf, 2, data.numElements)
+	putBigqueryVarint(buf, 3, uint64(h.p))
+	putBigqueryVarint(buf, 4, uint64(h.pPrime))
+	putBigqueryBytes(buf, 6, data.buf)
+	return buf.Bytes()
+}
 
-	return h, nil
+// bigqueryNormalState returns the HyperLogLogPlusUniqueStateProto for a normal Hll. ZetaSketch
+// stores one register per byte instead of our 6 bit packing.
+func (h *Hll) bigqueryNormalState() []byte {
+	data := make([]byte, h.m)
+	for i := range data {
+		data[i] = h.bigM.Get(uint64(i))
+	}
+
+	buf := proto.NewBuffer(nil)
+	putBigqueryVarint(buf, 3, uint64(h.p))
+	putBigqueryVarint(buf, 4, uint64(h.pPrime))
+	putBigqueryBytes(buf, 5, data)
+	return buf.Bytes()
+}
+
+func putBigqueryVarint(buf *proto.Buffer, field, v uint64) {
+	// Encoding to a proto.Buffer never fails.
+	_ = buf.EncodeVarint(field<<3 | proto.WireVarint)
+	_ = buf.EncodeVarint(v)
+}
+
+func putBigqueryBytes(buf *proto.Buffer, field uint64, b []byte) {
+	_ = buf.EncodeVarint(field<<3 | proto.WireBytes)
+	_ = buf.EncodeRawBytes(b)
 }
 
 const K0 uint64 = 0xa5b85c5e198ed849
@@ -319,8 +511,32 @@ func fullFingerprint(bytes []byte, offset, length int) uint64 {
 	return hash128to64(hash128to64(v[0], w[0])+shiftMix(y)*K1+z, hash128to64(v[1], w[1])+x)
 }
 
+// BigQueryHash returns the hash BigQuery uses for STRING values in HLL_COUNT.INIT.
 func BigQueryHash(s string) uint64 {
-	bytes := []byte(s)
+	return fingerprint([]byte(s))
+}
+
+// BigQueryHashBytes returns the hash BigQuery uses for BYTES values in HLL_COUNT.INIT.
+func BigQueryHashBytes(b []byte) uint64 {
+	return fingerprint(b)
+}
+
+// BigQueryHashInt64 returns the hash BigQuery uses for INT64 values in HLL_COUNT.INIT.
+func BigQueryHashInt64(v int64) uint64 {
+	return BigQueryHashUint64(uint64(v))
+}
+
+// BigQueryHashUint64 returns the hash ZetaSketch uses for unsigned 64 bit integers.
+func BigQueryHashUint64(v uint64) uint64 {
+	// ZetaSketch hashes integers as their little endian byte representation.
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return fingerprint(b[:])
+}
+
+// fingerprint is a port of Fingerprint2011 which ZetaSketch uses to hash all values.
+// See: https://github.com/google/zetasketch/blob/a2f2692fae8cf61103330f9f70e696c4ba8b94b0/java/com/google/zetasketch/internal/hash/Fingerprint2011.java
+func fingerprint(bytes []byte) uint64 {
 	offset := 0
 	length := len(bytes)
 	var result uint64
@@ -1,22 +1,30 @@
 package hll
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/golang/protobuf/proto"
 )
 
-func TestBigquery_Hash(t *testing.T) {
-	tests := []struct {
-		s string
-		h int64
-	}{
-		{"946a796f-0a2c-4ca1-88fb-84eb2c1ea5ba", -8603043174913211329},
-		{"XUQs3bXHPMKMMCKt9YUG4A", 4067187478817557856},
-		{"zxkDtvoziXOIoyy3gSFG4BxATZesk5ORvQ4hM1Qq8g1tS7j2w1lt3jeZ1iPNXED4DyhAXQ8PJ4qgAFqZ7TkVG91QSlbgqKTmDT32ExVImS60mYS1eU7H5RPCPztAxDD29FHRcPKzpRAKJdRGfWyafQezNqpCJ3THHdtLmVn1CrRHqrX2JCcjOji6hgXQYH2nWGa2S29zv2zexiibfvdfCiPhSK6wtBNM244AjGBTD5j6zKQgvnvB2FCVt0Dza9unbkwM4xic8s4harkle2UYLgkTXGVXFS80IuXgUNDjdKUjN7MynHAeJHrvyAeOHJAIdkAKXOCbQKWBeH9FLP1USdPvIgr3H2yhsf7wFWzMHmr9xODBgM46mGLijpzi4Jrz2IwBBSdaH5cEMaTpG6eFHiLmklFzpC3lenpLStKNiTIVsA3XKfLUv5Z3MPRyZXFCbG4CJMYUq89ZPpl7Q5bLPJrxYlqIPKy2fPefw180RZEj6yWcIkvjFmv4Q9y3wioDgZGB7BWYRsZBrm1sQSGbZFgWlnWU2s7OBu9xqBVtMYB56h0VJS1PvAKj1FOEyA12vrTBOjxKRMeG6v2UjdxIK5kmGUmDJ6cggtsANQo9JaFyrEejrYErF7RBZ5oTDe3W9exzHniMmagksiz3meF2zEDGV6TdLdrx07tNHhmF1e5rw1IK9VFOZAil0proqrOcuV7igEK0kIGnDBWhk3uX17D2dsgSk0oxzFkkrWUMDh7gBBmCDJuRS56eCzMCphSiUG2l3ljSUkiEBv2Shh95TpjNODCLLBMF2BF7XNFM7CkzpBpGdecSi8cEPpTXdpWWbvQMkRs4", 8486994667353352931},
-	}
+// bigqueryHashTests are hashes of STRING values from the original implementation of BigQueryHash.
+var bigqueryHashTests = []struct {
+	s string
+	h int64
+}{
+	{"946a796f-0a2c-4ca1-88fb-84eb2c1ea5ba", -8603043174913211329},
+	{"XUQs3bXHPMKMMCKt9YUG4A", 4067187478817557856},
+	{"zxkDtvoziXOIoyy3gSFG4BxATZesk5ORvQ4hM1Qq8g1tS7j2w1lt3jeZ1iPNXED4DyhAXQ8PJ4qgAFqZ7TkVG91QSlbgqKTmDT32ExVImS60mYS1eU7H5RPCPztAxDD29FHRcPKzpRAKJdRGfWyafQezNqpCJ3THHdtLmVn1CrRHqrX2JCcjOji6hgXQYH2nWGa2S29zv2zexiibfvdfCiPhSK6wtBNM244AjGBTD5j6zKQgvnvB2FCVt0Dza9unbkwM4xic8s4harkle2UYLgkTXGVXFS80IuXgUNDjdKUjN7MynHAeJHrvyAeOHJAIdkAKXOCbQKWBeH9FLP1USdPvIgr3H2yhsf7wFWzMHmr9xODBgM46mGLijpzi4Jrz2IwBBSdaH5cEMaTpG6eFHiLmklFzpC3lenpLStKNiTIVsA3XKfLUv5Z3MPRyZXFCbG4CJMYUq89ZPpl7Q5bLPJrxYlqIPKy2fPefw180RZEj6yWcIkvjFmv4Q9y3wioDgZGB7BWYRsZBrm1sQSGbZFgWlnWU2s7OBu9xqBVtMYB56h0VJS1PvAKj1FOEyA12vrTBOjxKRMeG6v2UjdxIK5kmGUmDJ6cggtsANQo9JaFyrEejrYErF7RBZ5oTDe3W9exzHniMmagksiz3meF2zEDGV6TdLdrx07tNHhmF1e5rw1IK9VFOZAil0proqrOcuV7igEK0kIGnDBWhk3uX17D2dsgSk0oxzFkkrWUMDh7gBBmCDJuRS56eCzMCphSiUG2l3ljSUkiEBv2Shh95TpjNODCLLBMF2BF7XNFM7CkzpBpGdecSi8cEPpTXdpWWbvQMkRs4", 8486994667353352931},
+}
 
-	for _, test := range tests {
+func TestBigquery_Hash(t *testing.T) {
+	for _, test := range bigqueryHashTests {
 		t.Run(test.s, func(t *testing.T) {
 			h := BigQueryHash(test.s)
 
@@ -27,6 +35,51 @@ func TestBigquery_Hash(t *testing.T) {
 	}
 }
 
+// There are no HLL_COUNT.INIT sketches of INT64 or BYTES columns to take expected hashes from, so
+// instead of constants these tests check the definitions the hashes are based on: ZetaSketch hashes
+// BYTES the same as a STRING with the same content, and integers as their 8 byte little endian
+// representation. The STRING hashes are checked against real sketches in TestBigquery_Sparse. The
+// INT64 encoding hasn't been verified against BigQuery output.
+
+func TestBigquery_HashInt64(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 42, 1234567890123, math.MaxInt64, math.MinInt64} {
+		t.Run(strconv.FormatInt(v, 10), func(t *testing.T) {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+
+			if h, expected := BigQueryHashInt64(v), BigQueryHash(string(b[:])); h != expected {
+				t.Errorf("expected %d got %d", int64(expected), int64(h))
+			}
+			if h, expected := BigQueryHashInt64(v), BigQueryHashUint64(uint64(v)); h != expected {
+				t.Errorf("expected the same hash as UINT64 %d, got %d", int64(expected), int64(h))
+			}
+		})
+	}
+}
+
+func TestBigquery_HashUint64(t *testing.T) {
+	for _, v := range []uint64{0, 1, math.MaxUint64, 9876543210} {
+		t.Run(strconv.FormatUint(v, 10), func(t *testing.T) {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], v)
+
+			if h, expected := BigQueryHashUint64(v), BigQueryHash(string(b[:])); h != expected {
+				t.Errorf("expected %d got %d", int64(expected), int64(h))
+			}
+		})
+	}
+}
+
+func TestBigquery_HashBytes(t *testing.T) {
+	for _, test := range bigqueryHashTests {
+		t.Run(test.s[:8], func(t *testing.T) {
+			if h := BigQueryHashBytes([]byte(test.s)); int64(h) != test.h {
+				t.Errorf("expected %d got %d", test.h, int64(h))
+			}
+		})
+	}
+}
+
 func TestBigquery_Null(t *testing.T) {
 	hll, err := NewHllFromBigquery(nil)
 	if err != nil {
@@ -63,6 +116,12 @@ func TestBigquery_Sparse(t *testing.T) {
 	if c := hll.Cardinality(); c != 2 {
 		t.Errorf("expected a Cardinality of 2, got %d", c)
 	}
+	if n := hll.NumValues(); n != 2 {
+		t.Errorf("expected NumValues of 2, got %d", n)
+	}
+	if vt := hll.ValueType(); vt != ValueTypeBytesOrString {
+		t.Errorf("expected ValueType %d, got %d", ValueTypeBytesOrString, vt)
+	}
 }
 
 func TestBigquery_SparseCombine(t *testing.T) {
@@ -215,3 +274,283 @@ func TestBigquery_Big1(t *testing.T) {
 		t.Errorf("expected a Cardinality of 100325, got %d", c)
 	}
 }
+
+func TestBigquery_Marshal(t *testing.T) {
+	tests := []string{
+		"CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ==",
+		"CHAQBBgCIAuCBxQQBBgPIBQyDL6cE8adDfmFA4SgGw==",
+		"CHAQAxgCIAuCBxAQAxgPIBQyCLPuCNB/sucL",
+	}
+
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			data, _ := base64.StdEncoding.DecodeString(test)
+
+			hll, err := NewHllFromBigquery(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := hll.MarshalBigquery()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out, data) {
+				t.Errorf("expected %x got %x", data, out)
+			}
+
+			rt, err := NewHllFromBigquery(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a, b := rt.Cardinality(), hll.Cardinality(); a != b {
+				t.Errorf("expected a Cardinality of %d, got %d", b, a)
+			}
+		})
+	}
+}
+
+func TestBigquery_MarshalRoundTrip(t *testing.T) {
+	h := NewHll(DefaultBigqueryP, DefaultBigqueryPPrime)
+	for i := 0; i < 100000; i++ {
+		if i%10000 == 0 {
+			data, err := h.MarshalBigquery()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rt, err := NewHllFromBigquery(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rt.isSparse != h.isSparse {
+				t.Errorf("expected isSparse %v, got %v", h.isSparse, rt.isSparse)
+			}
+			if a, b := rt.Cardinality(), h.Cardinality(); a != b {
+				t.Errorf("expected a Cardinality of %d, got %d", b, a)
+			}
+		}
+
+		h.Add(BigQueryHash(strconv.Itoa(i)))
+	}
+
+	if h.isSparse {
+		t.Error("expected the dense representation to be used")
+	}
+}
+
+// ZetaSketch expects the sparse values to be in ascending order.
+func TestBigquery_MarshalSparseOrder(t *testing.T) {
+	h := NewHll(DefaultBigqueryP, DefaultBigqueryPPrime)
+	for i := 0; i < 300; i++ {
+		h.Add(BigQueryHash(strconv.Itoa(i)))
+	}
+
+	data, err := h.MarshalBigquery()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s bigqueryState
+	if err := s.parse(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sparseData) == 0 {
+		t.Fatal("expected the sparse representation to be used")
+	}
+
+	r := wireReader{s.sparseData}
+	n := uint64(0)
+	for len(r.buf) > 0 {
+		delta, err := r.varint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A delta that wrapped around would be a huge number.
+		if delta >= 1<<32 {
+			t.Fatalf("delta %d is negative", delta)
+		}
+		n++
+	}
+	if n != s.sparseSize || n != h.sparseList.GetNumElements() {
+		t.Errorf("expected %d elements, got %d", h.sparseList.GetNumElements(), n)
+	}
+
+	rt, err := NewHllFromBigquery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rt.sparseList.buf, h.sparseList.buf) {
+		t.Error("expected the sparse list to be identical after a round trip")
+	}
+}
+
+func TestBigquery_MarshalPrecision(t *testing.T) {
+	if _, err := NewHll(9, 20).MarshalBigquery(); err == nil {
+		t.Error("expected an error for a precision of 9")
+	}
+	if _, err := NewHll(14, 26).MarshalBigquery(); err == nil {
+		t.Error("expected an error for a sparse precision of 26")
+	}
+}
+
+func TestBigquery_CombineValueType(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString("CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ==")
+
+	hll, err := NewHllFromBigquery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ints := NewHll(DefaultBigqueryP, DefaultBigqueryPPrime)
+	ints.SetValueType(ValueTypeInt64)
+	ints.Add(BigQueryHashInt64(1))
+
+	if err := hll.Combine(ints); err == nil {
+		t.Error("expected an error combining STRING and INT64 sketches")
+	}
+}
+
+// bigquerySketch builds a sketch the same way ZetaSketch would, allowing invalid values.
+func bigquerySketch(typ, version, precision, sparsePrecision, sparseSize uint64, normal, sparse []byte) []byte {
+	buf := proto.NewBuffer(nil)
+	putBigqueryVarint(buf, 1, typ)
+	putBigqueryVarint(buf, 3, version)
+	putBigqueryBytes(buf, bigqueryType, bigqueryHllState(precision, sparsePrecision, sparseSize, normal, sparse))
+	return buf.Bytes()
+}
+
+// bigqueryHllState returns a HyperLogLogPlusUniqueStateProto with the given fields.
+func bigqueryHllState(precision, sparsePrecision, sparseSize uint64, normal, sparse []byte) []byte {
+	state := proto.NewBuffer(nil)
+	putBigqueryVarint(state, 2, sparseSize)
+	putBigqueryVarint(state, 3, precision)
+	putBigqueryVarint(state, 4, sparsePrecision)
+	if normal != nil {
+		putBigqueryBytes(state, 5, normal)
+	}
+	if sparse != nil {
+		putBigqueryBytes(state, 6, sparse)
+	}
+	return state.Bytes()
+}
+
+func TestBigquery_Errors(t *testing.T) {
+	valid, _ := base64.StdEncoding.DecodeString("CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ==")
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"type", bigquerySketch(113, 2, 15, 20, 0, nil, nil), ErrUnsupportedType},
+		{"version", bigquerySketch(112, 1, 15, 20, 0, nil, nil), ErrUnsupportedVersion},
+		{"precision low", bigquerySketch(112, 2, 3, 20, 0, nil, nil), ErrBadPrecision},
+		{"precision high", bigquerySketch(112, 2, 19, 20, 0, nil, nil), ErrBadPrecision},
+		{"precision missing", bigquerySketch(112, 2, 0, 20, 0, nil, nil), ErrBadPrecision},
+		{"sparse precision low", bigquerySketch(112, 2, 15, 14, 0, nil, []byte{1}), ErrBadPrecision},
+		{"sparse precision high", bigquerySketch(112, 2, 15, 26, 0, nil, nil), ErrBadPrecision},
+		{"dense size", bigquerySketch(112, 2, 10, 20, 0, make([]byte, 1023), nil), ErrCorruptDense},
+		{"dense value", bigquerySketch(112, 2, 10, 20, 0, append(make([]byte, 1023), 56), nil), ErrCorruptDense},
+		{"both", bigquerySketch(112, 2, 10, 20, 1, make([]byte, 1024), []byte{1}), ErrMalformed},
+		{"sparse size", bigquerySketch(112, 2, 15, 20, 2, nil, []byte{1}), ErrCorruptSparse},
+		{"sparse size huge", bigquerySketch(112, 2, 15, 20, 1<<60, nil, []byte{1}), ErrCorruptSparse},
+		{"sparse varint", bigquerySketch(112, 2, 15, 20, 1, nil, []byte{0x80}), ErrCorruptSparse},
+		{"sparse index", bigquerySketch(112, 2, 15, 20, 1, nil, []byte{0x80, 0x80, 0x40}), ErrCorruptSparse},
+		{"sparse rhoW", bigquerySketch(112, 2, 15, 20, 1, nil, []byte{0x80, 0x80, 0x80, 0x01}), ErrCorruptSparse},
+		{"truncated", valid[:len(valid)-1], ErrMalformed},
+		{"bad varint", []byte{0x08, 0x80}, ErrMalformed},
+		{"wire type", []byte{0x0a, 0x00}, ErrMalformed},
+		{"field zero", []byte{0x00, 0x00}, ErrMalformed},
+		{"group", []byte{0x2b}, ErrMalformed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewHllFromBigquery(test.data)
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestBigquery_UnknownFields(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString("CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ==")
+
+	// Append an unknown fixed32 and fixed64 field.
+	data = append(data, 5<<3|proto.WireFixed32, 1, 2, 3, 4)
+	data = append(data, 6<<3|proto.WireFixed64, 1, 2, 3, 4, 5, 6, 7, 8)
+
+	hll, err := NewHllFromBigquery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := hll.Cardinality(); c != 2 {
+		t.Errorf("expected a Cardinality of 2, got %d", c)
+	}
+}
+
+func FuzzNewHllFromBigquery(f *testing.F) {
+	for _, s := range []string{
+		"CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ==",
+		"CHAQBBgCIAuCBxQQBBgPIBQyDL6cE8adDfmFA4SgGw==",
+		"CHAQAxgCIAuCBxAQAxgPIBQyCLPuCNB/sucL",
+	} {
+		data, _ := base64.StdEncoding.DecodeString(s)
+		f.Add(data)
+	}
+	f.Add(bigquerySketch(112, 2, 10, 20, 0, make([]byte, 1024), nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hll, err := NewHllFromBigquery(data)
+		if err != nil {
+			return
+		}
+
+		c := hll.Cardinality()
+		if hll.p < 10 {
+			return
+		}
+
+		out, err := hll.MarshalBigquery()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt, err := NewHllFromBigquery(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc := rt.Cardinality(); rc != c {
+			t.Errorf("expected a Cardinality of %d, got %d", c, rc)
+		}
+	})
+}
+
+func FuzzParseHllState(f *testing.F) {
+	f.Add(bigqueryHllState(15, 20, 2, nil, []byte{0xbe, 0x9c, 0x13, 0xc6, 0x9d, 0x0d}))
+	f.Add(bigqueryHllState(10, 20, 0, make([]byte, 1024), nil))
+	f.Add([]byte{2<<3 | proto.WireVarint, 0x80})
+	f.Add([]byte{5<<3 | proto.WireBytes, 10, 1})
+	f.Add([]byte{7<<3 | proto.WireFixed32, 1, 2, 3, 4})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var s bigqueryState
+		if err := s.parseHllState(data); err != nil {
+			return
+		}
+
+		// Encode the fields that were read and parse them again.
+		var rt bigqueryState
+		if err := rt.parseHllState(bigqueryHllState(s.precision, s.sparsePrecision, s.sparseSize, s.normalData, s.sparseData)); err != nil {
+			t.Fatal(err)
+		}
+		if rt.sparseSize != s.sparseSize || rt.precision != s.precision || rt.sparsePrecision != s.sparsePrecision ||
+			!bytes.Equal(rt.normalData, s.normalData) || !bytes.Equal(rt.sparseData, s.sparseData) {
+			t.Errorf("expected %+v, got %+v", s, rt)
+		}
+	})
+}
@@ -0,0 +1,403 @@
+package hll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The binary format is:
+//
+//	magic       4 bytes  0x89 'H' 'L' 'L'
+//	version     1 byte   binaryVersion
+//	flags       1 byte   binaryFlagChecksum and binaryFlagHasher, other bits are zero
+//	p           1 byte
+//	pPrime      1 byte
+//	repr        1 byte   binarySparse or binaryDense
+//	codec       1 byte   the Codec of the data
+//	numValues   uvarint
+//	valueType   uvarint
+//	hasher      uvarint length followed by the name of the Hasher, only if binaryFlagHasher is set
+//
+// For the sparse representation:
+//
+//	numElements uvarint
+//	size        uvarint  number of bytes of elements
+//	elements    uvarint deltas, the same as the sparse list in memory
+//
+// For the dense representation:
+//
+//	registers   m*3/4+1 bytes of 6 bit registers, the same as normal in memory
+//
+// Unless the codec is CodecNone, the elements or registers are compressed and preceded by the size
+// after compression as uvarint.
+//
+// The checksum is only present if binaryFlagChecksum is set, it is the CRC-32C of everything before
+// it, as 4 bytes little endian.
+//
+// Readers must reject versions they don't know. A new version is needed for any change that older
+// readers would decode incorrectly.
+const (
+	binaryVersion = 1
+
+	binaryFlagChecksum = 1
+	binaryFlagHasher   = 2
+
+	binarySparse = 0
+	binaryDense  = 1
+)
+
+var (
+	binaryMagic = []byte{0x89, 'H', 'L', 'L'}
+	crc32c      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler. The format is versioned and includes a
+// checksum, it can be decoded with UnmarshalBinary or ReadFrom.
+func (h *Hll) MarshalBinary() ([]byte, error) {
+	h.mergeTmpSetIfAny()
+
+	buf := make([]byte, 0, 32+len(h.bigM))
+	if h.isSparse {
+		buf = make([]byte, 0, 32+len(h.sparseList.buf))
+	}
+	buf = append(buf, binaryMagic...)
+	flags := byte(binaryFlagChecksum)
+	if h.hasher != nil {
+		flags |= binaryFlagHasher
+	}
+	buf = append(buf, binaryVersion, flags, byte(h.p), byte(h.pPrime))
+
+	codec := h.encodingCodec()
+
+	var (
+		data []byte
+		err  error
+	)
+	if h.isSparse {
+		data, err = compress(codec, h.sparseList.buf)
+		buf = append(buf, binarySparse, byte(codec))
+	} else {
+		data, err = h.compressedRegisters(codec)
+		buf = append(buf, binaryDense, byte(codec))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf = appendUvarint(buf, h.numValues)
+	buf = appendUvarint(buf, uint64(uint32(h.valueType)))
+	if h.hasher != nil {
+		name := h.hasher.Name()
+		buf = appendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+
+	if h.isSparse {
+		buf = appendUvarint(buf, h.sparseList.numElements)
+		buf = appendUvarint(buf, uint64(len(h.sparseList.buf)))
+	}
+
+	if codec != CodecNone {
+		buf = appendUvarint(buf, uint64(len(data)))
+	}
+	buf = append(buf, data...)
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(buf, crc32c))
+	return append(buf, sum[:]...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The data has to contain exactly one Hll.
+func (h *Hll) UnmarshalBinary(data []byte) error {
+	r := newBinaryReader(bytes.NewReader(data))
+
+	d, err := readBinary(r)
+	if err != nil {
+		return err
+	}
+	if r.n != int64(len(data)) {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformed, int64(len(data))-r.n)
+	}
+
+	*h = *d
+	return nil
+}
+
+// WriteTo implements io.WriterTo. It writes the same data as MarshalBinary.
+func (h *Hll) WriteTo(w io.Writer) (int64, error) {
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom implements io.ReaderFrom. It reads one Hll written by WriteTo or MarshalBinary and
+// doesn't read past its end, so multiple Hlls can be read from the same stream.
+func (h *Hll) ReadFrom(r io.Reader) (int64, error) {
+	br := newBinaryReader(r)
+
+	d, err := readBinary(br)
+	if err != nil {
+		return br.n, err
+	}
+
+	*h = *d
+	return br.n, nil
+}
+
+func readBinary(r *binaryReader) (*Hll, error) {
+	var header [10]byte
+	if err := r.readFull(header[:]); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], binaryMagic) {
+		return nil, fmt.Errorf("%w: missing magic number", ErrMalformed)
+	}
+
+	version, flags, p, pPrime, repr := header[4], header[5], header[6], header[7], header[8]
+	if version != binaryVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	codec := Codec(header[9])
+	if codec < CodecNone || codec > CodecDeflate {
+		return nil, fmt.Errorf("%w: codec %d", ErrUnsupportedType, codec)
+	}
+
+	if flags&^(binaryFlagChecksum|binaryFlagHasher) != 0 {
+		return nil, fmt.Errorf("%w: unknown flags %#x", ErrMalformed, flags)
+	}
+	h, err := New(WithPrecision(uint(p)), WithSparsePrecision(uint(pPrime)))
+	if err != nil {
+		return nil, err
+	}
+
+	if h.numValues, err = r.uvarint(); err != nil {
+		return nil, err
+	}
+	valueType, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if valueType > 0xffffffff {
+		return nil, fmt.Errorf("%w: value type %d", ErrMalformed, valueType)
+	}
+	h.valueType = ValueType(int32(uint32(valueType)))
+
+	if flags&binaryFlagHasher != 0 {
+		n, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || n > maxHasherName {
+			return nil, fmt.Errorf("%w: hasher name of %d bytes", ErrMalformed, n)
+		}
+		name := make([]byte, n)
+		if err := r.readFull(name); err != nil {
+			return nil, err
+		}
+		if h.hasher, err = lookupHasher(string(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch repr {
+	case binarySparse:
+		err = h.readBinarySparse(r, codec)
+	case binaryDense:
+		err = h.readBinaryDense(r, codec)
+	default:
+		err = fmt.Errorf("%w: representation %d", ErrUnsupportedType, repr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&binaryFlagChecksum != 0 {
+		expected := r.crc.Sum32()
+
+		var sum [4]byte
+		if err := r.readFull(sum[:]); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != expected {
+			return nil, ErrChecksum
+		}
+	}
+
+	return h, nil
+}
+
+func (h *Hll) readBinarySparse(r *binaryReader, codec Codec) error {
+	numElements, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	size, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+
+	// Every element takes at least one byte, and the sparse list never grows beyond the threshold.
+	if numElements > size || size > uint64(h.maxSparseSize()) {
+		return fmt.Errorf("%w: %d elements in %d bytes", ErrCorruptSparse, numElements, size)
+	}
+
+	data, err := r.readData(codec, int(size))
+	if err != nil {
+		return err
+	}
+	buf, err := decompress(codec, data, int(size))
+	if err != nil {
+		return err
+	}
+	if uint64(len(buf)) != size {
+		return fmt.Errorf("%w: expected %d bytes of elements, got %d", ErrCorruptSparse, size, len(buf))
+	}
+
+	return h.setSparseList(buf, numElements)
+}
+
+func (h *Hll) readBinaryDense(r *binaryReader, codec Codec) error {
+	data, err := r.readData(codec, int(h.m*3/4+1))
+	if err != nil {
+		return err
+	}
+
+	return h.setCompressedRegisters(codec, data)
+}
+
+// setSparseList validates an encoded sparse list and uses it as the sparse list of h.
+func (h *Hll) setSparseList(buf []byte, numElements uint64) error {
+	// The elements have to be sorted by index without duplicates, otherwise merging with the
+	// temporary set breaks. Elements with an encoded rhoW are larger than the elements around them,
+	// so the deltas can wrap.
+	s := &sparse{buf: buf}
+	var lastIdx uint64
+	for len(buf) > 0 {
+		delta, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return fmt.Errorf("%w: invalid delta", ErrCorruptSparse)
+		}
+		buf = buf[n:]
+
+		k := s.lastVal + delta
+		if !validSparseHash(k, h.p, h.pPrime) {
+			return fmt.Errorf("%w: invalid element %#x", ErrCorruptSparse, k)
+		}
+
+		idx, _ := decodeSparseHash(k, h.p, h.pPrime)
+		if s.numElements > 0 && idx <= lastIdx {
+			return fmt.Errorf("%w: element %#x out of order", ErrCorruptSparse, k)
+		}
+
+		lastIdx = idx
+		s.lastVal = k
+		s.numElements++
+	}
+
+	if s.numElements != numElements {
+		return fmt.Errorf("%w: expected %d elements, got %d", ErrCorruptSparse, numElements, s.numElements)
+	}
+
+	h.isSparse = true
+	h.sparseList = s
+	h.bigM = nil
+	return nil
+}
+
+// setNormal validates the packed registers in buf and uses them as the registers of h.
+func (h *Hll) setNormal(buf []byte) error {
+	M := normal(buf)
+	if uint64(len(M)) != h.m*3/4+1 {
+		return fmt.Errorf("%w: expected %d bytes of registers, got %d", ErrCorruptDense, h.m*3/4+1, len(M))
+	}
+	if M[len(M)-1] != 0 {
+		// The last byte is padding, the registers end in the byte before it.
+		return fmt.Errorf("%w: non-zero padding", ErrCorruptDense)
+	}
+
+	maxRhoW := uint8(64 - h.p + 1)
+	for i := uint64(0); i < h.m; i++ {
+		if r := M.Get(i); r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+	}
+
+	h.isSparse = false
+	h.sparseList = nil
+	h.bigM = M
+	return nil
+}
+
+// binaryReader reads from r while counting the bytes and computing the checksum.
+type binaryReader struct {
+	r   io.Reader
+	n   int64
+	crc hash.Hash32
+}
+
+func newBinaryReader(r io.Reader) *binaryReader {
+	return &binaryReader{r: r, crc: crc32.New(crc32c)}
+}
+
+// readFull reads exactly len(buf) bytes. Running out of data is reported as ErrMalformed.
+func (r *binaryReader) readFull(buf []byte) error {
+	n, err := io.ReadFull(r.r, buf)
+	r.n += int64(n)
+	r.crc.Write(buf[:n])
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end of data", ErrMalformed)
+	}
+	return err
+}
+
+// readData reads the elements or registers. They are size bytes if codec is CodecNone, otherwise
+// they are preceded by their compressed size and returned without decompressing them.
+func (r *binaryReader) readData(codec Codec, size int) ([]byte, error) {
+	if codec == CodecNone {
+		buf := make([]byte, size)
+		return buf, r.readFull(buf)
+	}
+
+	compressedSize, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if compressedSize > maxCompressedInput {
+		return nil, fmt.Errorf("%w: %d compressed bytes", ErrMalformed, compressedSize)
+	}
+
+	buf := make([]byte, compressedSize)
+	return buf, r.readFull(buf)
+}
+
+func (r *binaryReader) ReadByte() (byte, error) {
+	var b [1]byte
+	err := r.readFull(b[:])
+	return b[0], err
+}
+
+func (r *binaryReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil && !errors.Is(err, ErrMalformed) {
+		return 0, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return v, err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
@@ -0,0 +1,153 @@
+package hll
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	testCases := []struct {
+		p, pPrime uint
+	}{
+		{5, 10},
+		{10, 25},
+		{14, 14},
+		{15, 31},
+	}
+
+	for _, testCase := range testCases {
+		h := NewHll(testCase.p, testCase.pPrime)
+		h.SetValueType(ValueTypeDouble)
+		for i := uint64(0); i <= 1e5; i++ {
+			if i%5000 == 0 {
+				data, err := h.MarshalBinary()
+				assert.Equalf(t, nil, err, "%v", err)
+
+				rt := &Hll{}
+				err = rt.UnmarshalBinary(data)
+				assert.Equalf(t, nil, err, "%v", err)
+
+				assert.Equal(t, rt.isSparse, h.isSparse)
+				assert.Equal(t, rt.Cardinality(), h.Cardinality())
+				assert.Equal(t, rt.NumValues(), h.NumValues())
+				assert.Equal(t, rt.ValueType(), ValueTypeDouble)
+				assert.Equal(t, registers(rt), registers(h))
+
+				// The result has to be usable like any other Hll.
+				rt.Add(randUint64(t))
+				assert.Equal(t, nil, rt.Combine(h))
+			}
+
+			h.Add(randUint64(t))
+		}
+
+		assert.T(t, !h.isSparse)
+	}
+}
+
+func TestBinaryReadFrom(t *testing.T) {
+	sparse := NewHll(14, 25)
+	dense := NewHll(10, 20)
+	for i := 0; i < 10000; i++ {
+		if i < 100 {
+			sparse.Add(randUint64(t))
+		}
+		dense.Add(randUint64(t))
+	}
+	assert.T(t, sparse.isSparse)
+	assert.T(t, !dense.isSparse)
+
+	var buf bytes.Buffer
+	n1, err := sparse.WriteTo(&buf)
+	assert.Equal(t, nil, err)
+	n2, err := dense.WriteTo(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n1+n2, int64(buf.Len()))
+
+	rt := &Hll{}
+	n, err := rt.ReadFrom(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n1, n)
+	assert.Equal(t, sparse.Cardinality(), rt.Cardinality())
+
+	n, err = rt.ReadFrom(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, n2, n)
+	assert.Equal(t, dense.Cardinality(), rt.Cardinality())
+
+	_, err = rt.ReadFrom(&buf)
+	assert.T(t, errors.Is(err, ErrMalformed))
+}
+
+func TestBinaryErrors(t *testing.T) {
+	h := NewHll(4, 10)
+	for i := uint64(1); i <= 4; i++ {
+		h.Add(i<<60 | 1<<40)
+	}
+	valid, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+
+	// The sparse elements start after the header, numValues, valueType, numElements and size.
+	const elements = 14
+
+	testCases := []struct {
+		name   string
+		modify func(data []byte) []byte
+		err    error
+	}{
+		{"empty", func(data []byte) []byte { return nil }, ErrMalformed},
+		{"magic", func(data []byte) []byte { data[1] = 'X'; return data }, ErrMalformed},
+		{"version", func(data []byte) []byte { data[4] = 2; return data }, ErrUnsupportedVersion},
+		{"flags", func(data []byte) []byte { data[5] = 5; return data }, ErrMalformed},
+		{"p", func(data []byte) []byte { data[6] = 19; return data }, ErrBadPrecision},
+		{"pPrime", func(data []byte) []byte { data[7] = 3; return data }, ErrBadPrecision},
+		{"representation", func(data []byte) []byte { data[8] = 2; return data }, ErrUnsupportedType},
+		{"codec", func(data []byte) []byte { data[9] = 0; return data }, ErrUnsupportedType},
+		{"truncated", func(data []byte) []byte { return data[:len(data)-5] }, ErrMalformed},
+		{"trailing", func(data []byte) []byte { return append(data, 0) }, ErrMalformed},
+		{"checksum", func(data []byte) []byte { data[len(data)-1] ^= 1; return data }, ErrChecksum},
+		{"element count", func(data []byte) []byte { data[elements-2]++; return data }, ErrCorruptSparse},
+		{"element", func(data []byte) []byte { data[elements] = 0; return data }, ErrCorruptSparse},
+	}
+
+	for _, testCase := range testCases {
+		data := testCase.modify(append([]byte{}, valid...))
+		err := (&Hll{}).UnmarshalBinary(data)
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.err, err)
+		}
+	}
+}
+
+func TestBinaryCorruptDense(t *testing.T) {
+	h := NewHll(4, 4)
+	h.switchToNormal()
+	h.bigM.Set(3, 61)
+
+	data, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, (&Hll{}).UnmarshalBinary(data))
+
+	h.bigM.Set(3, 62)
+	data, err = h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.T(t, errors.Is((&Hll{}).UnmarshalBinary(data), ErrCorruptDense))
+}
+
+func TestGobDecodeJSON(t *testing.T) {
+	h := NewHll(10, 20)
+	for i := 0; i < 100; i++ {
+		h.Add(randUint64(t))
+	}
+
+	// Older versions used the JSON encoding for gob.
+	data, err := h.MarshalJSON()
+	assert.Equal(t, nil, err)
+
+	rt := &Hll{}
+	assert.Equal(t, nil, rt.GobDecode(data))
+	assert.Equal(t, h.Cardinality(), rt.Cardinality())
+}
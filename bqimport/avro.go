@@ -0,0 +1,622 @@
+package bqimport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/erikdubbelboer/hll"
+)
+
+// The Avro object container file format is described at
+// https://avro.apache.org/docs/1.11.1/specification/#object-container-files
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+const avroSyncSize = 16
+
+// avroMaxBlockSize is the maximum size of a decompressed block. Writers keep blocks much smaller,
+// BigQuery and the Java library use about 64 KiB, the limit only prevents a small compressed block
+// from using all memory.
+const avroMaxBlockSize = 64 << 20
+
+// avroMaxDepth is the maximum nesting of values. BigQuery allows 15 levels of nested records, which
+// are at most two levels each in Avro: a union for NULLABLE or an array for REPEATED, and the record.
+const avroMaxDepth = 100
+
+var errAvroTruncated = errors.New("avro: truncated data")
+
+// avroType is a parsed Avro schema.
+type avroType struct {
+	kind    string      // A primitive type name, or record, enum, array, map, fixed or union.
+	fields  []avroField // For records.
+	items   *avroType   // For arrays.
+	values  *avroType   // For maps.
+	union   []*avroType // For unions.
+	symbols []string    // For enums.
+	size    int         // For fixed.
+	logical string      // The logicalType of an int or long.
+
+	// zero is true for types that are encoded as zero bytes, like null and records of only null
+	// fields. Their values are skipped without decoding, see setZeroSize.
+	zero bool
+}
+
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+// avroSchema parses a JSON Avro schema, resolving references to named types.
+type avroSchema struct {
+	named map[string]*avroType
+}
+
+func (s *avroSchema) parse(raw json.RawMessage, namespace string) (*avroType, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		switch name {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: name}, nil
+		}
+		if t, ok := s.named[name]; ok {
+			return t, nil
+		}
+		if t, ok := s.named[namespace+"."+name]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("avro: unknown type %q", name)
+	}
+
+	var union []json.RawMessage
+	if err := json.Unmarshal(raw, &union); err == nil {
+		t := &avroType{kind: "union"}
+		for _, u := range union {
+			ut, err := s.parse(u, namespace)
+			if err != nil {
+				return nil, err
+			}
+			t.union = append(t.union, ut)
+		}
+		return t, nil
+	}
+
+	var complex struct {
+		Type      json.RawMessage `json:"type"`
+		Name      string          `json:"name"`
+		Namespace string          `json:"namespace"`
+		Fields    []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+		Items       json.RawMessage `json:"items"`
+		Values      json.RawMessage `json:"values"`
+		Symbols     []string        `json:"symbols"`
+		Size        int             `json:"size"`
+		LogicalType string          `json:"logicalType"`
+	}
+	if err := json.Unmarshal(raw, &complex); err != nil {
+		return nil, fmt.Errorf("avro: invalid schema: %w", err)
+	}
+	var kind string
+	if err := json.Unmarshal(complex.Type, &kind); err != nil {
+		// Something like {"type": {"type": "string"}}.
+		return s.parse(complex.Type, namespace)
+	}
+	if complex.Namespace != "" {
+		namespace = complex.Namespace
+	}
+
+	if kind == "error" {
+		// Errors are records that are used in protocols.
+		kind = "record"
+	}
+
+	t := &avroType{kind: kind}
+	switch kind {
+	case "record", "enum", "fixed":
+		// Register the name first so recursive types resolve.
+		s.named[complex.Name] = t
+		if namespace != "" {
+			s.named[namespace+"."+complex.Name] = t
+		}
+	}
+
+	switch t.kind {
+	case "record":
+		for _, f := range complex.Fields {
+			ft, err := s.parse(f.Type, namespace)
+			if err != nil {
+				return nil, err
+			}
+			t.fields = append(t.fields, avroField{f.Name, ft})
+		}
+	case "enum":
+		t.symbols = complex.Symbols
+	case "fixed":
+		if complex.Size < 0 {
+			return nil, fmt.Errorf("avro: invalid fixed size %d", complex.Size)
+		}
+		t.size = complex.Size
+	case "array":
+		items, err := s.parse(complex.Items, namespace)
+		if err != nil {
+			return nil, err
+		}
+		t.items = items
+	case "map":
+		values, err := s.parse(complex.Values, namespace)
+		if err != nil {
+			return nil, err
+		}
+		t.values = values
+	default:
+		// A primitive type with attributes like logicalType.
+		pt, err := s.parse(complex.Type, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if pt.kind == "int" || pt.kind == "long" {
+			pt.logical = complex.LogicalType
+		}
+		return pt, nil
+	}
+	return t, nil
+}
+
+// setZeroSize sets zero for all types reachable from root. Records that contain themselves without
+// a union, array or map in between can't be encoded and are treated as zero size as well.
+func setZeroSize(root *avroType) {
+	var types []*avroType
+	seen := make(map[*avroType]bool)
+	var walk func(t *avroType)
+	walk = func(t *avroType) {
+		if t == nil || seen[t] {
+			return
+		}
+		seen[t] = true
+		types = append(types, t)
+		for _, f := range t.fields {
+			walk(f.typ)
+		}
+		for _, u := range t.union {
+			walk(u)
+		}
+		walk(t.items)
+		walk(t.values)
+	}
+	walk(root)
+
+	for _, t := range types {
+		t.zero = t.kind == "null" || t.kind == "record" || (t.kind == "fixed" && t.size == 0)
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, t := range types {
+			if !t.zero || t.kind != "record" {
+				continue
+			}
+			for _, f := range t.fields {
+				if !f.typ.zero {
+					t.zero = false
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// avroDecoder decodes Avro binary encoded data from a buffer.
+type avroDecoder struct {
+	buf   []byte
+	depth int
+}
+
+func (d *avroDecoder) long() (int64, error) {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		return 0, errAvroTruncated
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+func (d *avroDecoder) next(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(d.buf)) {
+		return nil, errAvroTruncated
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *avroDecoder) bytes() ([]byte, error) {
+	n, err := d.long()
+	if err != nil {
+		return nil, err
+	}
+	return d.next(n)
+}
+
+// value decodes a value of type t. Only values that can be used as a key or sketch are returned,
+// others are skipped and nil is returned.
+func (d *avroDecoder) value(t *avroType) (interface{}, error) {
+	if t.zero {
+		return nil, nil
+	}
+	if d.depth++; d.depth > avroMaxDepth {
+		return nil, fmt.Errorf("avro: values nested more than %d levels", avroMaxDepth)
+	}
+	defer func() { d.depth-- }()
+
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		v, err := d.long()
+		if err != nil || t.logical == "" {
+			return v, err
+		}
+		return avroLogicalValue(t.logical, v), nil
+	case "float":
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes":
+		return d.bytes()
+	case "string":
+		b, err := d.bytes()
+		return string(b), err
+	case "fixed":
+		return d.next(int64(t.size))
+	case "enum":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return nil, fmt.Errorf("avro: invalid enum index %d", i)
+		}
+		return t.symbols[i], nil
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.union)) {
+			return nil, fmt.Errorf("avro: invalid union index %d", i)
+		}
+		return d.value(t.union[i])
+	case "record":
+		for _, f := range t.fields {
+			if _, err := d.value(f.typ); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case "array", "map":
+		for {
+			n, err := d.long()
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return nil, nil
+			}
+			if n < 0 {
+				// A negative count is followed by the size of the block in bytes, which allows skipping it.
+				size, err := d.long()
+				if err != nil {
+					return nil, err
+				}
+				if _, err := d.next(size); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if t.kind == "array" && t.items.zero {
+				continue
+			}
+			// Every item is at least one byte, map keys have a length.
+			if n > int64(len(d.buf)) {
+				return nil, errAvroTruncated
+			}
+			for i := int64(0); i < n; i++ {
+				if t.kind == "map" {
+					if _, err := d.bytes(); err != nil {
+						return nil, err
+					}
+					if _, err := d.value(t.values); err != nil {
+						return nil, err
+					}
+				} else if _, err := d.value(t.items); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("avro: unsupported type %q", t.kind)
+}
+
+// avroLogicalValue formats the value of an int or long with a logical type the way BigQuery's JSON
+// and CSV exports do, so the same rows get the same key in every format. Values of other logical
+// types are returned as is.
+func avroLogicalValue(logical string, v int64) interface{} {
+	switch logical {
+	case "date":
+		return time.Unix(v*24*60*60, 0).UTC().Format("2006-01-02")
+	case "time-millis":
+		return time.UnixMilli(v).UTC().Format("15:04:05.999")
+	case "time-micros":
+		return time.UnixMicro(v).UTC().Format("15:04:05.999999")
+	case "timestamp-millis":
+		return time.UnixMilli(v).UTC().Format("2006-01-02 15:04:05.999 UTC")
+	case "timestamp-micros":
+		return time.UnixMicro(v).UTC().Format("2006-01-02 15:04:05.999999 UTC")
+	}
+	return v
+}
+
+// avroKeyValue converts a decoded value to a key column value, nil is NULL.
+func avroKeyValue(v interface{}) sql.NullString {
+	if v == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: avroString(v), Valid: true}
+}
+
+// avroString formats a decoded value that isn't nil.
+func avroString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// avroReader reads the blocks of an object container file.
+type avroReader struct {
+	r      *bufio.Reader
+	codec  string
+	sync   [avroSyncSize]byte
+	schema *avroType
+}
+
+func (a *avroReader) long() (int64, error) {
+	v, err := binary.ReadVarint(a.r)
+	if err == io.EOF {
+		return 0, errAvroTruncated
+	}
+	return v, err
+}
+
+func (a *avroReader) readHeader() error {
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(a.r, magic); err != nil || !bytes.Equal(magic, avroMagic) {
+		return fmt.Errorf("avro: not an object container file")
+	}
+
+	meta := make(map[string][]byte)
+	for {
+		n, err := a.long()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			n = -n
+			if _, err := a.long(); err != nil { // Block size in bytes.
+				return err
+			}
+		}
+		for i := int64(0); i < n; i++ {
+			key, err := a.readBytes()
+			if err != nil {
+				return err
+			}
+			value, err := a.readBytes()
+			if err != nil {
+				return err
+			}
+			meta[string(key)] = value
+		}
+	}
+
+	if _, err := io.ReadFull(a.r, a.sync[:]); err != nil {
+		return errAvroTruncated
+	}
+
+	a.codec = string(meta["avro.codec"])
+	if a.codec == "" {
+		a.codec = "null"
+	}
+	if a.codec != "null" && a.codec != "deflate" {
+		return fmt.Errorf("avro: unsupported codec %q", a.codec)
+	}
+
+	s := avroSchema{named: make(map[string]*avroType)}
+	schema, err := s.parse(meta["avro.schema"], "")
+	if err != nil {
+		return err
+	}
+	if schema.kind != "record" {
+		return fmt.Errorf("avro: expected a record schema, got %q", schema.kind)
+	}
+	setZeroSize(schema)
+	a.schema = schema
+	return nil
+}
+
+func (a *avroReader) readBytes() ([]byte, error) {
+	n, err := a.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errAvroTruncated
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, a.r, n); err != nil {
+		return nil, errAvroTruncated
+	}
+	return buf.Bytes(), nil
+}
+
+// readBlock returns the number of objects in the next block and their decompressed data. It returns
+// io.EOF when there are no more blocks.
+func (a *avroReader) readBlock() (int64, []byte, error) {
+	if _, err := a.r.Peek(1); err == io.EOF {
+		return 0, nil, io.EOF
+	}
+
+	count, err := a.long()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := a.readBytes()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var sync [avroSyncSize]byte
+	if _, err := io.ReadFull(a.r, sync[:]); err != nil {
+		return 0, nil, errAvroTruncated
+	}
+	if sync != a.sync {
+		return 0, nil, fmt.Errorf("avro: sync marker mismatch")
+	}
+
+	if a.codec == "deflate" {
+		r := io.LimitReader(flate.NewReader(bytes.NewReader(data)), avroMaxBlockSize+1)
+		if data, err = io.ReadAll(r); err != nil {
+			return 0, nil, fmt.Errorf("avro: %w", err)
+		}
+		if len(data) > avroMaxBlockSize {
+			return 0, nil, fmt.Errorf("avro: block is larger than %d bytes", avroMaxBlockSize)
+		}
+	}
+	return count, data, nil
+}
+
+// ReadAvro reads an Avro object container file export and merges all sketches in it. Only the null
+// and deflate codecs are supported. The sketch column must be of type bytes, key columns can be of
+// any primitive type. Key columns with a date, time or timestamp logical type are formatted like
+// BigQuery's JSON and CSV exports do, for example 2006-01-02 15:04:05.999999 UTC. Values of other
+// logical types, like numeric, are used as is and give different keys than the other formats.
+func (m *Merger) ReadAvro(r io.Reader, c Config) error {
+	a := avroReader{r: bufio.NewReader(r)}
+	if err := a.readHeader(); err != nil {
+		return err
+	}
+
+	columns := make(map[string]int, len(a.schema.fields))
+	for i, f := range a.schema.fields {
+		if _, ok := columns[f.name]; !ok {
+			columns[f.name] = i
+		}
+	}
+
+	sketchIdx, ok := columns[c.SketchColumn]
+	if !ok {
+		return fmt.Errorf("column %q not found", c.SketchColumn)
+	}
+	// A column can be used more than once, like ReadCSV allows.
+	keyIdx := make(map[int][]int)
+	for j, column := range c.KeyColumns {
+		i, ok := columns[column]
+		if !ok {
+			return fmt.Errorf("column %q not found", column)
+		}
+		keyIdx[i] = append(keyIdx[i], j)
+	}
+
+	values := make([]sql.NullString, len(c.KeyColumns))
+	row := 0
+	for {
+		count, data, err := a.readBlock()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Every record takes at least one byte, unless all fields are encoded as zero bytes. Those
+		// records are limited as if they took one byte each so a block can't make us spin.
+		if count < 0 || (count > int64(len(data)) && !a.schema.zero) || count > avroMaxBlockSize {
+			return fmt.Errorf("avro: invalid block count %d for %d bytes", count, len(data))
+		}
+
+		d := avroDecoder{buf: data}
+		for i := int64(0); i < count; i++ {
+			row++
+
+			var sketch []byte
+			for j, f := range a.schema.fields {
+				v, err := d.value(f.typ)
+				if err != nil {
+					return fmt.Errorf("row %d: column %q: %w", row, f.name, err)
+				}
+
+				if j == sketchIdx {
+					var ok bool
+					if sketch, ok = v.([]byte); !ok && v != nil {
+						return fmt.Errorf("row %d: column %q is not of type bytes", row, f.name)
+					}
+				}
+				for _, k := range keyIdx[j] {
+					values[k] = avroKeyValue(v)
+				}
+			}
+
+			if err := m.Add(NewNullableKey(values...), sketch); err != nil {
+				return fmt.Errorf("row %d: %w", row, err)
+			}
+		}
+		if len(d.buf) > 0 {
+			return fmt.Errorf("avro: %d bytes left after the last record of a block", len(d.buf))
+		}
+	}
+}
+
+// ReadAvro reads an Avro object container file export and returns the merged sketch for every group.
+func ReadAvro(r io.Reader, c Config) (map[Key]*hll.Hll, error) {
+	m := NewMerger()
+	if err := m.ReadAvro(r, c); err != nil {
+		return nil, err
+	}
+	return m.Groups(), nil
+}
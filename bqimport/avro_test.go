@@ -0,0 +1,346 @@
+package bqimport
+
+import (
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// avroWriter writes object container files for testing.
+type avroWriter struct {
+	bytes.Buffer
+}
+
+func (w *avroWriter) long(v int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutVarint(buf, v)])
+}
+
+func (w *avroWriter) bytes(b []byte) {
+	w.long(int64(len(b)))
+	w.Write(b)
+}
+
+var avroTestSync = []byte("0123456789abcdef")
+
+// avroFile returns an object container file with the given schema and blocks of encoded records.
+func avroFile(t testing.TB, schema, codec string, blocks ...[][]byte) []byte {
+	var w avroWriter
+	w.Write(avroMagic)
+	w.long(2)
+	w.bytes([]byte("avro.schema"))
+	w.bytes([]byte(schema))
+	w.bytes([]byte("avro.codec"))
+	w.bytes([]byte(codec))
+	w.long(0)
+	w.Write(avroTestSync)
+
+	for _, records := range blocks {
+		data := bytes.Join(records, nil)
+		if codec == "deflate" {
+			var buf bytes.Buffer
+			fw, err := flate.NewWriter(&buf, flate.BestCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write(data)
+			fw.Close()
+			data = buf.Bytes()
+		}
+
+		w.long(int64(len(records)))
+		w.bytes(data)
+		w.Write(avroTestSync)
+	}
+	return w.Bytes()
+}
+
+// This is what BigQuery uses for a table with a nullable STRING, INT64, ARRAY<STRING> and BYTES column.
+const avroTestSchema = `{
+	"type": "record",
+	"name": "Root",
+	"fields": [
+		{"name": "country", "type": ["null", "string"]},
+		{"name": "day", "type": ["null", {"type": "long", "logicalType": "timestamp-micros"}]},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "h", "type": ["null", "bytes"]}
+	]
+}`
+
+func avroRecord(t testing.TB, country string, day int64, encodedSketch string) []byte {
+	var w avroWriter
+	if country == "" {
+		w.long(0)
+	} else {
+		w.long(1)
+		w.bytes([]byte(country))
+	}
+	w.long(1)
+	w.long(day)
+	w.long(2)
+	w.bytes([]byte("a"))
+	w.bytes([]byte("b"))
+	w.long(0)
+	if encodedSketch == "" {
+		w.long(0)
+	} else {
+		sketch, err := base64.StdEncoding.DecodeString(encodedSketch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.long(1)
+		w.bytes(sketch)
+	}
+	return w.Bytes()
+}
+
+func TestReadAvro(t *testing.T) {
+	for _, codec := range []string{"null", "deflate"} {
+		t.Run(codec, func(t *testing.T) {
+			const day = 1600000000000000 // In microseconds.
+			file := avroFile(t, avroTestSchema, codec,
+				[][]byte{
+					avroRecord(t, "nl", day, sketch(t, "a", "b")),
+					avroRecord(t, "nl", day, sketch(t, "b", "c")),
+				},
+				[][]byte{
+					avroRecord(t, "de", day, sketch(t, "a")),
+					avroRecord(t, "nl", day+1, ""),
+					avroRecord(t, "", day+1, sketch(t, "x", "y", "z")),
+				},
+			)
+
+			groups, err := ReadAvro(bytes.NewReader(file), Config{
+				SketchColumn: "h",
+				KeyColumns:   []string{"country", "day"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Timestamps are formatted like in JSON and CSV exports.
+			checkGroups(t, groups, map[Key]uint64{
+				NewKey("nl", "2020-09-13 12:26:40 UTC"): 3,
+				NewKey("de", "2020-09-13 12:26:40 UTC"): 1,
+				NewNullableKey(sql.NullString{}, sql.NullString{String: "2020-09-13 12:26:40.000001 UTC", Valid: true}): 3,
+			})
+		})
+	}
+}
+
+func TestReadAvroErrors(t *testing.T) {
+	c := Config{SketchColumn: "h", KeyColumns: []string{"country"}}
+	valid := avroFile(t, avroTestSchema, "null", [][]byte{avroRecord(t, "nl", 1, sketch(t, "a"))})
+
+	tests := []struct {
+		name string
+		data []byte
+		c    Config
+	}{
+		{"magic", []byte("Obj\x02"), c},
+		{"truncated", valid[:len(valid)-20], c},
+		{"sync", append(valid[:len(valid)-1:len(valid)-1], 'x'), c},
+		{"codec", avroFile(t, avroTestSchema, "snappy"), c},
+		{"schema", avroFile(t, `{"type": "foo"}`, "null"), c},
+		{"not a record", avroFile(t, `"string"`, "null"), c},
+		{"sketch column", valid, Config{SketchColumn: "x"}},
+		{"key column", valid, Config{SketchColumn: "h", KeyColumns: []string{"country", "x"}}},
+		{"sketch type", valid, Config{SketchColumn: "country"}},
+		{"array count", avroFile(t, avroArraySchema("string"), "null", [][]byte{avroArrayRecord(1 << 40)}), c},
+		{"nesting", avroFile(t, avroNestedSchema, "null", [][]byte{avroNestedRecord(avroMaxDepth)}), c},
+		{"block count", avroBlock(avroFile(t, avroTestSchema, "null"), 1<<62, nil), c},
+		{"negative block count", avroBlock(avroFile(t, avroTestSchema, "null"), -1, nil), c},
+		{"zero size block count", avroBlock(avroFile(t, avroNullSchema, "null"), 1<<62, nil), c},
+		{"trailing bytes", avroBlock(avroFile(t, avroTestSchema, "null"), 1, append(avroRecord(t, "nl", 1, sketch(t, "a")), 0)), c},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadAvro(bytes.NewReader(test.data), test.c); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// avroNullSchema has only fields that are encoded as zero bytes.
+const avroNullSchema = `{"type": "record", "name": "Root", "fields": [
+	{"name": "country", "type": "null"},
+	{"name": "h", "type": "null"}
+]}`
+
+// avroBlock appends a block with the given count and data to file.
+func avroBlock(file []byte, count int64, data []byte) []byte {
+	w := avroWriter{*bytes.NewBuffer(file)}
+	w.long(count)
+	w.bytes(data)
+	w.Write(avroTestSync)
+	return w.Bytes()
+}
+
+func avroArraySchema(items string) string {
+	return `{"type": "record", "name": "Root", "fields": [
+		{"name": "a", "type": {"type": "array", "items": "` + items + `"}},
+		{"name": "h", "type": "bytes"}
+	]}`
+}
+
+// avroArrayRecord returns a record of avroArraySchema with a single block of n items that are all
+// encoded as zero bytes, and an empty sketch.
+func avroArrayRecord(n int64) []byte {
+	var w avroWriter
+	w.long(n)
+	w.long(0)
+	w.bytes(nil)
+	return w.Bytes()
+}
+
+const avroNestedSchema = `{"type": "record", "name": "Root", "fields": [
+	{"name": "next", "type": ["null", "Root"]},
+	{"name": "h", "type": "bytes"}
+]}`
+
+// avroNestedRecord returns a record of avroNestedSchema with depth nested records.
+func avroNestedRecord(depth int) []byte {
+	var w avroWriter
+	for i := 0; i < depth; i++ {
+		w.long(1)
+	}
+	w.long(0)
+	for i := 0; i <= depth; i++ {
+		w.bytes(nil)
+	}
+	return w.Bytes()
+}
+
+func TestReadAvroLimits(t *testing.T) {
+	c := Config{SketchColumn: "h"}
+
+	// Items that are encoded as zero bytes are skipped without decoding them one by one.
+	file := avroFile(t, avroArraySchema("null"), "null", [][]byte{avroArrayRecord(1 << 62)})
+	if _, err := ReadAvro(bytes.NewReader(file), c); err != nil {
+		t.Error(err)
+	}
+
+	file = avroFile(t, avroNestedSchema, "null", [][]byte{avroNestedRecord(avroMaxDepth/2 - 1)})
+	if _, err := ReadAvro(bytes.NewReader(file), c); err != nil {
+		t.Error(err)
+	}
+
+	// Records that are encoded as zero bytes don't need any data.
+	file = avroBlock(avroFile(t, avroNullSchema, "null"), 1000, nil)
+	if _, err := ReadAvro(bytes.NewReader(file), c); err != nil {
+		t.Error(err)
+	}
+
+	// A block that decompresses to more than avroMaxBlockSize.
+	file = avroFile(t, avroArraySchema("null"), "deflate", [][]byte{make([]byte, avroMaxBlockSize+1)})
+	if _, err := ReadAvro(bytes.NewReader(file), c); err == nil || !strings.Contains(err.Error(), "larger") {
+		t.Errorf("expected a block size error, got %v", err)
+	}
+}
+
+func TestReadAvroKeys(t *testing.T) {
+	schema := `{"type": "record", "name": "Root", "fields": [
+		{"name": "date", "type": {"type": "int", "logicalType": "date"}},
+		{"name": "time", "type": {"type": "long", "logicalType": "time-micros"}},
+		{"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "n", "type": "long"},
+		{"name": "h", "type": "bytes"}
+	]}`
+	data, _ := base64.StdEncoding.DecodeString(sketch(t, "a"))
+
+	var w avroWriter
+	w.long(18518)
+	w.long(45296000001)
+	w.long(1600000000123)
+	w.long(18518)
+	w.bytes(data)
+
+	groups, err := ReadAvro(bytes.NewReader(avroFile(t, schema, "null", [][]byte{w.Bytes()})), Config{
+		SketchColumn: "h",
+		KeyColumns:   []string{"date", "time", "ts", "n", "date"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGroups(t, groups, map[Key]uint64{
+		NewKey("2020-09-13", "12:34:56.000001", "2020-09-13 12:26:40.123 UTC", "18518", "2020-09-13"): 1,
+	})
+}
+
+func FuzzReadAvro(f *testing.F) {
+	for _, codec := range []string{"null", "deflate"} {
+		f.Add(avroFile(f, avroTestSchema, codec, [][]byte{
+			avroRecord(f, "nl", 1, "CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ=="),
+			avroRecord(f, "", 2, ""),
+		}))
+	}
+	f.Add(avroFile(f, avroArraySchema("null"), "null", [][]byte{avroArrayRecord(3)}))
+	f.Add(avroFile(f, avroNestedSchema, "null", [][]byte{avroNestedRecord(3)}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadAvro(bytes.NewReader(data), Config{SketchColumn: "h", KeyColumns: []string{"country", "day"}})
+	})
+}
+
+func TestAvroSchema(t *testing.T) {
+	s := avroSchema{named: make(map[string]*avroType)}
+	typ, err := s.parse([]byte(`{
+		"type": "record",
+		"name": "Root",
+		"namespace": "ns",
+		"fields": [
+			{"name": "e", "type": {"type": "enum", "name": "E", "symbols": ["A", "B"]}},
+			{"name": "f", "type": {"type": "fixed", "name": "F", "size": 2}},
+			{"name": "m", "type": {"type": "map", "values": "F"}},
+			{"name": "r", "type": ["null", "ns.Root"]},
+			{"name": "d", "type": "double"}
+		]
+	}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w avroWriter
+	w.long(1)             // e
+	w.Write([]byte("xy")) // f
+	// m, a single block prefixed with its size in bytes.
+	w.long(-1)
+	w.long(4)
+	w.bytes([]byte("k"))
+	w.Write([]byte("zz"))
+	w.long(0)
+	// r, a nested record with an empty map and null.
+	w.long(1)
+	w.long(0)
+	w.Write([]byte("ab"))
+	w.long(0)
+	w.long(0)
+	w.Write(make([]byte, 8))
+	// d
+	w.Write(make([]byte, 8))
+
+	d := avroDecoder{buf: w.Bytes()}
+	for i, f := range typ.fields {
+		v, err := d.value(f.typ)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if i == 0 && v != "B" {
+			t.Errorf("expected B got %v", v)
+		}
+	}
+	if len(d.buf) != 0 {
+		t.Errorf("expected all data to be read, %d bytes left", len(d.buf))
+	}
+
+	if _, err := s.parse([]byte(`{"type": "array", "items": "Unknown"}`), ""); err == nil ||
+		!strings.Contains(err.Error(), "Unknown") {
+		t.Errorf("expected an unknown type error, got %v", err)
+	}
+}
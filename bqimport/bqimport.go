@@ -0,0 +1,249 @@
+// Package bqimport reads sketches produced by BigQuery's HLL_COUNT.INIT from table exports and
+// merges them per group.
+//
+// Newline delimited JSON, CSV and Avro exports are supported. Exports are read row by row so they
+// don't need to fit in memory, only one sketch per group is kept. BYTES columns in JSON and CSV
+// exports are expected to be base64 encoded, which is what BigQuery does.
+package bqimport
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/erikdubbelboer/hll"
+)
+
+// Key identifies a group. It holds the values of the key columns in the order they were configured.
+// Every value is prefixed with its length plus one as uvarint so values can contain any byte, a NULL
+// value is a single 0 so it forms a different group than an empty string, like in BigQuery. Use
+// NewKey or NewNullableKey to create a Key.
+type Key string
+
+// NewKey returns the Key for the given key column values.
+func NewKey(values ...string) Key {
+	var b strings.Builder
+	for _, v := range values {
+		writeKeyValue(&b, sql.NullString{String: v, Valid: true})
+	}
+	return Key(b.String())
+}
+
+// NewNullableKey returns the Key for the given key column values, values that aren't Valid are NULL.
+func NewNullableKey(values ...sql.NullString) Key {
+	var b strings.Builder
+	for _, v := range values {
+		writeKeyValue(&b, v)
+	}
+	return Key(b.String())
+}
+
+func writeKeyValue(b *strings.Builder, v sql.NullString) {
+	if !v.Valid {
+		b.WriteByte(0)
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], uint64(len(v.String))+1)])
+	b.WriteString(v.String)
+}
+
+// Values returns the key column values, NULL values aren't Valid. Decoding stops at the first value
+// that is invalid, which only happens for a Key that wasn't created with NewKey or NewNullableKey.
+func (k Key) Values() []sql.NullString {
+	var values []sql.NullString
+	for len(k) > 0 {
+		n, size := binary.Uvarint([]byte(k))
+		if size <= 0 || (n > 0 && n-1 > uint64(len(k)-size)) {
+			break
+		}
+		k = k[size:]
+		if n == 0 {
+			values = append(values, sql.NullString{})
+			continue
+		}
+		values = append(values, sql.NullString{String: string(k[:n-1]), Valid: true})
+		k = k[n-1:]
+	}
+	return values
+}
+
+// Config describes the layout of an export.
+type Config struct {
+	// SketchColumn is the name of the column holding the HLL_COUNT.INIT output.
+	SketchColumn string
+
+	// KeyColumns are the columns to group by. Without key columns all sketches are merged into a
+	// single group with an empty Key. NULL values form their own group, separate from empty
+	// strings. CSV exports can't tell them apart, there every value is an empty string.
+	KeyColumns []string
+}
+
+// Merger merges sketches per group.
+type Merger struct {
+	groups map[Key]*hll.Hll
+}
+
+// NewMerger returns an empty Merger. Use one of its Read methods for every export, or Add for
+// sketches that come from somewhere else, and Groups to get the result.
+func NewMerger() *Merger {
+	return &Merger{
+		groups: make(map[Key]*hll.Hll),
+	}
+}
+
+// Add decodes a sketch produced by HLL_COUNT.INIT and merges it into the group for key. Empty
+// sketches, which is what BigQuery uses for NULL, are ignored.
+func (m *Merger) Add(key Key, sketch []byte) error {
+	if len(sketch) == 0 {
+		return nil
+	}
+
+	h, err := hll.NewHllFromBigquery(sketch)
+	if err != nil {
+		return err
+	}
+
+	if g, ok := m.groups[key]; ok {
+		return g.Combine(h)
+	}
+	m.groups[key] = h
+	return nil
+}
+
+// Groups returns the merged sketch for every group.
+func (m *Merger) Groups() map[Key]*hll.Hll {
+	return m.groups
+}
+
+// ReadJSON reads a newline delimited JSON export and merges all sketches in it.
+func (m *Merger) ReadJSON(r io.Reader, c Config) error {
+	dec := json.NewDecoder(r)
+	values := make([]sql.NullString, len(c.KeyColumns))
+
+	for row := 1; ; row++ {
+		var fields map[string]json.RawMessage
+		if err := dec.Decode(&fields); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("row %d: %w", row, err)
+		}
+
+		// A missing column is a NULL value.
+		raw, ok := fields[c.SketchColumn]
+		if !ok {
+			continue
+		}
+		var encoded *string
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return fmt.Errorf("row %d: column %q: %w", row, c.SketchColumn, err)
+		}
+		if encoded == nil {
+			continue
+		}
+
+		for i, column := range c.KeyColumns {
+			v, err := jsonValue(fields[column])
+			if err != nil {
+				return fmt.Errorf("row %d: column %q: %w", row, column, err)
+			}
+			values[i] = v
+		}
+
+		if err := m.add(values, *encoded); err != nil {
+			return fmt.Errorf("row %d: %w", row, err)
+		}
+	}
+}
+
+// ReadCSV reads a CSV export with a header row and merges all sketches in it.
+func (m *Merger) ReadCSV(r io.Reader, c Config) error {
+	rdr := csv.NewReader(r)
+	rdr.ReuseRecord = true
+
+	header, err := rdr.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	sketchIdx, ok := columns[c.SketchColumn]
+	if !ok {
+		return fmt.Errorf("column %q not found", c.SketchColumn)
+	}
+	keyIdx := make([]int, len(c.KeyColumns))
+	for i, column := range c.KeyColumns {
+		if keyIdx[i], ok = columns[column]; !ok {
+			return fmt.Errorf("column %q not found", column)
+		}
+	}
+
+	values := make([]sql.NullString, len(c.KeyColumns))
+	for row := 1; ; row++ {
+		record, err := rdr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for i, idx := range keyIdx {
+			values[i] = sql.NullString{String: record[idx], Valid: true}
+		}
+
+		if err := m.add(values, record[sketchIdx]); err != nil {
+			return fmt.Errorf("row %d: %w", row, err)
+		}
+	}
+}
+
+func (m *Merger) add(values []sql.NullString, encoded string) error {
+	sketch, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	return m.Add(NewNullableKey(values...), sketch)
+}
+
+// jsonValue returns a JSON value as a string. Strings are unquoted, NULL and missing values aren't
+// Valid and other values are returned as is.
+func jsonValue(raw json.RawMessage) (sql.NullString, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return sql.NullString{}, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return sql.NullString{String: s, Valid: true}, err
+	}
+	return sql.NullString{String: string(raw), Valid: true}, nil
+}
+
+// ReadJSON reads a newline delimited JSON export and returns the merged sketch for every group.
+func ReadJSON(r io.Reader, c Config) (map[Key]*hll.Hll, error) {
+	m := NewMerger()
+	if err := m.ReadJSON(r, c); err != nil {
+		return nil, err
+	}
+	return m.Groups(), nil
+}
+
+// ReadCSV reads a CSV export with a header row and returns the merged sketch for every group.
+func ReadCSV(r io.Reader, c Config) (map[Key]*hll.Hll, error) {
+	m := NewMerger()
+	if err := m.ReadCSV(r, c); err != nil {
+		return nil, err
+	}
+	return m.Groups(), nil
+}
@@ -0,0 +1,166 @@
+package bqimport
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/erikdubbelboer/hll"
+)
+
+// sketch returns a base64 encoded HLL_COUNT.INIT sketch containing the given values.
+func sketch(t *testing.T, values ...string) string {
+	h := hll.NewHll(hll.DefaultBigqueryP, hll.DefaultBigqueryPPrime)
+	for _, v := range values {
+		h.Add(hll.BigQueryHash(v))
+	}
+	data, err := h.MarshalBigquery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func checkGroups(t *testing.T, groups map[Key]*hll.Hll, expected map[Key]uint64) {
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %d groups, got %d", len(expected), len(groups))
+	}
+	for key, c := range expected {
+		h, ok := groups[key]
+		if !ok {
+			t.Fatalf("group %v not found", key.Values())
+		}
+		if hc := h.Cardinality(); hc != c {
+			t.Errorf("group %v: expected a Cardinality of %d, got %d", key.Values(), c, hc)
+		}
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	input := fmt.Sprintf(`{"country":"nl","day":1,"h":%q}
+{"country":"nl","day":1,"h":%q}
+{"country":"de","day":1,"h":%q}
+{"country":"nl","day":2,"h":null}
+{"country":null,"day":2,"h":%q}
+{"country":"","day":2,"h":%q}
+{"country":"de","day":1}
+`,
+		sketch(t, "a", "b"),
+		sketch(t, "b", "c"),
+		sketch(t, "a"),
+		sketch(t, "x", "y", "z"),
+		sketch(t, "x"),
+	)
+
+	groups, err := ReadJSON(strings.NewReader(input), Config{
+		SketchColumn: "h",
+		KeyColumns:   []string{"country", "day"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGroups(t, groups, map[Key]uint64{
+		NewKey("nl", "1"): 3,
+		NewKey("de", "1"): 1,
+		NewKey("", "2"):   1,
+		NewNullableKey(sql.NullString{}, sql.NullString{String: "2", Valid: true}): 3,
+	})
+}
+
+func TestReadJSON_NoKeys(t *testing.T) {
+	// From TestBigquery_Sparse and TestBigquery_SparseCombine in the hll package.
+	input := `{"h":"CHAQAhgCIAuCBw4QAhgPIBQyBr6cE8adDQ=="}
+{"h":"CHAQBBgCIAuCBxQQBBgPIBQyDL6cE8adDfmFA4SgGw=="}`
+
+	groups, err := ReadJSON(strings.NewReader(input), Config{SketchColumn: "h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGroups(t, groups, map[Key]uint64{
+		NewKey(): 4,
+	})
+	if n := groups[NewKey()].NumValues(); n != 6 {
+		t.Errorf("expected NumValues of 6, got %d", n)
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	input := fmt.Sprintf("country,h,day\nnl,%s,1\nnl,%s,1\nde,%s,1\nnl,,2\n\"a,b\",%s,2\n",
+		sketch(t, "a", "b"),
+		sketch(t, "b", "c"),
+		sketch(t, "a"),
+		sketch(t, "x", "y", "z"),
+	)
+
+	groups, err := ReadCSV(strings.NewReader(input), Config{
+		SketchColumn: "h",
+		KeyColumns:   []string{"country", "day"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGroups(t, groups, map[Key]uint64{
+		NewKey("nl", "1"):  3,
+		NewKey("de", "1"):  1,
+		NewKey("a,b", "2"): 3,
+	})
+}
+
+func TestReadErrors(t *testing.T) {
+	c := Config{SketchColumn: "h", KeyColumns: []string{"k"}}
+
+	if _, err := ReadCSV(strings.NewReader("k,x\n"), c); err == nil {
+		t.Error("expected an error for a missing sketch column")
+	}
+	if _, err := ReadCSV(strings.NewReader("h\n"), c); err == nil {
+		t.Error("expected an error for a missing key column")
+	}
+	if _, err := ReadCSV(strings.NewReader("k,h\na,!!\n"), c); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+	if _, err := ReadJSON(strings.NewReader(`{"k":"a","h":"AAAA"}`), c); err == nil {
+		t.Error("expected an error for an invalid sketch")
+	}
+	if _, err := ReadJSON(strings.NewReader(`{"k":"a","h":1}`), c); err == nil {
+		t.Error("expected an error for a sketch that isn't a string")
+	}
+	if _, err := ReadJSON(strings.NewReader(`{"k":"a"`), c); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestKey(t *testing.T) {
+	if NewKey("a\x00", "b") == NewKey("a", "\x00b") {
+		t.Error("expected different keys")
+	}
+	if NewKey("a", "") == NewKey("a") {
+		t.Error("expected different keys")
+	}
+
+	if NewNullableKey(sql.NullString{}) == NewKey("") {
+		t.Error("expected NULL and an empty string to be different keys")
+	}
+
+	for _, values := range [][]string{{"nl", "1"}, {"", "a\x00b", strings.Repeat("x", 200)}} {
+		expected := make([]sql.NullString, len(values))
+		for i, v := range values {
+			expected[i] = sql.NullString{String: v, Valid: true}
+		}
+		if v := NewKey(values...).Values(); !reflect.DeepEqual(v, expected) {
+			t.Errorf("expected %v, got %v", expected, v)
+		}
+	}
+	nullable := []sql.NullString{{}, {String: "", Valid: true}, {}, {String: "a", Valid: true}}
+	if v := NewNullableKey(nullable...).Values(); !reflect.DeepEqual(v, nullable) {
+		t.Errorf("expected %v, got %v", nullable, v)
+	}
+	if v := NewKey().Values(); len(v) != 0 {
+		t.Errorf("expected no values, got %v", v)
+	}
+}
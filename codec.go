@@ -0,0 +1,203 @@
+package hll
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression used for the sparse list or registers by MarshalBinary, MarshalPb and
+// MarshalJSON. The codec is stored in the encoded data as the value of its constant, decoding always
+// uses the codec that was used for encoding. CodecDefault is never stored.
+type Codec uint8
+
+const (
+	// CodecDefault picks the codec based on the representation, see defaultCodec.
+	CodecDefault Codec = iota
+	CodecNone
+	CodecSnappy
+	CodecZstd
+	CodecDeflate
+)
+
+// maxCompressedInput is the size above which decoders don't need to decompress anything. It is a
+// bit more than the registers of an Hll with p 18, stored as one byte each.
+const maxCompressedInput = 1<<18 + 1<<10
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecDefault:
+		return "default"
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	case CodecDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint8(c))
+	}
+}
+
+// SetCodec sets the codec used when encoding the Hll. The setting itself isn't encoded, a decoded
+// Hll uses CodecDefault again.
+func (h *Hll) SetCodec(c Codec) {
+	h.codec = c
+}
+
+// Codec returns the codec set with SetCodec.
+func (h *Hll) Codec() Codec {
+	return h.codec
+}
+
+// encodingCodec returns the codec to use for the current representation.
+func (h *Hll) encodingCodec() Codec {
+	if h.codec != CodecDefault {
+		return h.codec
+	}
+	return defaultCodec(h.isSparse)
+}
+
+// defaultCodec returns the codec for a representation when none is set. The sparse list consists of
+// varints of mostly random differences that don't compress well, only deflate saves a few percent
+// and it is more than ten times slower. The registers of dense sketches mostly contain small
+// values, zstd makes them about 40% smaller. deflate is slightly smaller but ten times slower. See
+// BenchmarkCodec.
+func defaultCodec(isSparse bool) Codec {
+	if isSparse {
+		return CodecNone
+	}
+	return CodecZstd
+}
+
+func initZstd() {
+	var err error
+	if zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); err != nil {
+		panic(err)
+	}
+	if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxCompressedInput)); err != nil {
+		panic(err)
+	}
+}
+
+func compress(c Codec, in []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return in, nil
+	case CodecSnappy:
+		return snappy.Encode(nil, in), nil
+	case CodecZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(in, nil), nil
+	case CodecDeflate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(in); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %v", c)
+	}
+}
+
+// compressedRegisters returns the registers of a dense Hll compressed with c. Unless c is CodecNone
+// the registers are stored as one byte each before compressing, the 6 bit values don't line up with
+// bytes which makes packed registers hard to compress.
+func (h *Hll) compressedRegisters(c Codec) ([]byte, error) {
+	if c == CodecNone {
+		return h.bigM, nil
+	}
+
+	registers := make([]byte, h.m)
+	for i := range registers {
+		registers[i] = h.bigM.Get(uint64(i))
+	}
+	return compress(c, registers)
+}
+
+// setCompressedRegisters is the inverse of compressedRegisters.
+func (h *Hll) setCompressedRegisters(c Codec, in []byte) error {
+	if c == CodecNone {
+		return h.setNormal(in)
+	}
+
+	registers, err := decompress(c, in, int(h.m))
+	if err != nil {
+		return err
+	}
+	if uint64(len(registers)) != h.m {
+		return fmt.Errorf("%w: expected %d registers, got %d", ErrCorruptDense, h.m, len(registers))
+	}
+
+	M := newNormal(h.m)
+	maxRhoW := uint8(64 - h.p + 1)
+	for i, r := range registers {
+		if r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+		M.Set(uint64(i), r)
+	}
+	return h.setNormal(M)
+}
+
+// decompress decompresses in, which is expected to be at most maxSize bytes when decompressed.
+func decompress(c Codec, in []byte, maxSize int) ([]byte, error) {
+	var (
+		out []byte
+		err error
+	)
+
+	switch c {
+	case CodecNone:
+		out = in
+	case CodecSnappy:
+		var n int
+		if n, err = snappy.DecodedLen(in); err == nil && n > maxSize {
+			return nil, fmt.Errorf("%w: %d bytes after decompression", ErrMalformed, n)
+		}
+		if err == nil {
+			out, err = snappy.Decode(nil, in)
+		}
+	case CodecZstd:
+		zstdOnce.Do(initZstd)
+		out, err = zstdDecoder.DecodeAll(in, nil)
+	case CodecDeflate:
+		r := flate.NewReader(bytes.NewReader(in))
+		out, err = io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	default:
+		return nil, fmt.Errorf("%w: codec %v", ErrUnsupportedType, c)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", ErrMalformed, c, err)
+	}
+	if len(out) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes after decompression", ErrMalformed, maxSize)
+	}
+
+	// The snappy library returns nil when the output length is zero.
+	if out == nil {
+		out = []byte{}
+	}
+	return out, nil
+}
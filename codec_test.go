@@ -0,0 +1,127 @@
+package hll
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+var allCodecs = []Codec{CodecDefault, CodecNone, CodecSnappy, CodecZstd, CodecDeflate}
+
+func TestCodecRoundTrip(t *testing.T) {
+	type encoding struct {
+		name      string
+		marshal   func(h *Hll) ([]byte, error)
+		unmarshal func(h *Hll, data []byte) error
+	}
+	encodings := []encoding{
+		{"binary", (*Hll).MarshalBinary, (*Hll).UnmarshalBinary},
+		{"pb", (*Hll).MarshalPb, (*Hll).UnmarshalPb},
+		{"json", (*Hll).MarshalJSON, (*Hll).UnmarshalJSON},
+	}
+
+	sparse := NewHll(14, 25)
+	dense := NewHll(14, 25)
+	for i := 0; i < 20000; i++ {
+		if i < 1000 {
+			sparse.Add(randUint64(t))
+		}
+		dense.Add(randUint64(t))
+	}
+	assert.T(t, sparse.isSparse)
+	assert.T(t, !dense.isSparse)
+
+	for _, h := range []*Hll{sparse, dense} {
+		for _, c := range allCodecs {
+			h.SetCodec(c)
+			for _, e := range encodings {
+				data, err := e.marshal(h)
+				assert.Equalf(t, nil, err, "%s %v: %v", e.name, c, err)
+
+				rt := &Hll{}
+				err = e.unmarshal(rt, data)
+				assert.Equalf(t, nil, err, "%s %v: %v", e.name, c, err)
+				assert.Equalf(t, h.Dump(), rt.Dump(), "%s %v", e.name, c)
+			}
+		}
+	}
+}
+
+func TestCodecLegacyJSON(t *testing.T) {
+	h := NewHll(4, 4)
+	h.switchToNormal()
+	h.bigM.Set(1, 3)
+
+	// Older versions didn't store the codec and always used snappy.
+	M, err := compressB64(CodecSnappy, h.bigM)
+	assert.Equal(t, nil, err)
+	data := fmt.Sprintf(`{"M":"%s","p":4,"pp":4}`, M)
+
+	rt := &Hll{}
+	assert.Equal(t, nil, json.Unmarshal([]byte(data), rt))
+	assert.Equal(t, h.Dump(), rt.Dump())
+}
+
+func TestCodecDecompressLimit(t *testing.T) {
+	big := make([]byte, 1<<16)
+	for _, c := range []Codec{CodecSnappy, CodecZstd, CodecDeflate} {
+		compressed, err := compress(c, big)
+		assert.Equal(t, nil, err)
+
+		_, err = decompress(c, compressed, len(big)-1)
+		assert.Tf(t, errors.Is(err, ErrMalformed), "%v: %v", c, err)
+
+		out, err := decompress(c, compressed, len(big))
+		assert.Equal(t, nil, err)
+		assert.T(t, bytes.Equal(big, out))
+
+		_, err = decompress(c, []byte("garbage"), len(big))
+		assert.Tf(t, errors.Is(err, ErrMalformed), "%v: %v", c, err)
+	}
+
+	_, err := decompress(Codec(100), nil, 1)
+	assert.T(t, errors.Is(err, ErrUnsupportedType))
+}
+
+// BenchmarkCodec reports the encoded size next to the time it takes to encode and decode. It is
+// the basis of defaultCodec.
+func BenchmarkCodec(b *testing.B) {
+	for _, p := range []uint{14, 16} {
+		sparse := NewHll(p, 25)
+		dense := NewHll(p, 25)
+		for i := uint64(0); i < 1<<(p+2); i++ {
+			x := mrand.Uint64()
+			if i < 1<<(p-4) {
+				sparse.Add(x)
+			}
+			dense.Add(x)
+		}
+
+		for _, h := range []*Hll{sparse, dense} {
+			repr := "dense"
+			if h.isSparse {
+				repr = "sparse"
+			}
+
+			for _, c := range allCodecs[1:] {
+				h.SetCodec(c)
+				b.Run(fmt.Sprintf("p=%d/%s/%v", p, repr, c), func(b *testing.B) {
+					var data []byte
+					rt := &Hll{}
+					for i := 0; i < b.N; i++ {
+						data, _ = h.MarshalBinary()
+						if err := rt.UnmarshalBinary(data); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(len(data)), "bytes")
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package hll
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DataSketchesType is the register layout of an Apache DataSketches HLL sketch.
+type DataSketchesType uint8
+
+const (
+	DataSketchesHLL4 DataSketchesType = 0 // 4 bit registers with an exception table.
+	DataSketchesHLL6 DataSketchesType = 1 // 6 bit registers.
+	DataSketchesHLL8 DataSketchesType = 2 // 8 bit registers.
+)
+
+// DataSketchesPPrime is the pPrime of sketches created by NewHllFromDataSketches.
+const DataSketchesPPrime = 25
+
+// The serialization format is described in HllPreambleUtil.java.
+// See: https://github.com/apache/datasketches-java/blob/4.2.0/src/main/java/org/apache/datasketches/hll/HllPreambleUtil.java
+const (
+	dsSerVer = 1
+	dsFamily = 7
+
+	dsListPreInts = 2
+	dsSetPreInts  = 3
+	dsHllPreInts  = 10
+
+	dsModeList = 0
+	dsModeSet  = 1
+	dsModeHll  = 2
+
+	dsFlagEmpty      = 4
+	dsFlagCompact    = 8
+	dsFlagOutOfOrder = 16
+
+	dsListIntArrStart = 8
+	dsSetIntArrStart  = 12
+	dsHllByteArrStart = 40
+
+	dsKeyBits = 26 // Coupons store a 26 bit slot and a 6 bit value.
+	dsKeyMask = 1<<dsKeyBits - 1
+
+	dsAuxToken = 15 // The HLL_4 nibble that marks a register stored in the exception table.
+
+	dsLgInitListSize = 3
+	dsLgInitSetSize  = 5
+)
+
+// lgAuxArrInts is the minimum log2 size of the HLL_4 exception table for every lgK.
+var lgAuxArrInts = [...]uint8{0, 2, 2, 2, 2, 2, 2, 3, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 11, 12, 13}
+
+// NewHllFromDataSketches decodes an Apache DataSketches HLL sketch in any of its LIST, SET, HLL_4,
+// HLL_6 or HLL_8 forms. The resulting Hll has p equal to lgK and pPrime DataSketchesPPrime.
+//
+// DataSketches uses the low bits of a 128 bit murmur3 hash as the register index and the leading
+// zeros of the high bits as the register value. Coupons are converted into hashes that result in
+// the same register values, they should only be combined with other sketches converted from
+// DataSketches. DataSketches only supports lgK up to 21, values above 18 result in ErrBadPrecision.
+func NewHllFromDataSketches(data []byte) (*Hll, error) {
+	if len(data) < dsListIntArrStart {
+		return nil, fmt.Errorf("%w: sketch too short", ErrMalformed)
+	}
+
+	preInts, serVer, family, lgK, lgArr, flags := data[0], data[1], data[2], data[3], data[4], data[5]
+	mode, tgtType := data[7]&3, DataSketchesType(data[7]>>2&3)
+
+	if family != dsFamily {
+		return nil, fmt.Errorf("%w: family %d", ErrUnsupportedType, family)
+	}
+	if serVer != dsSerVer {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, serVer)
+	}
+	if lgK < 4 || lgK > 18 {
+		return nil, fmt.Errorf("%w: lgK %d", ErrBadPrecision, lgK)
+	}
+	if tgtType > DataSketchesHLL8 {
+		return nil, fmt.Errorf("%w: target type %d", ErrUnsupportedType, tgtType)
+	}
+
+	h := NewHll(uint(lgK), DataSketchesPPrime)
+	if flags&dsFlagEmpty != 0 {
+		return h, nil
+	}
+
+	compact := flags&dsFlagCompact != 0
+
+	switch {
+	case mode == dsModeList && preInts == dsListPreInts:
+		count := int(data[6])
+		if !compact {
+			// A LIST is promoted once its array of 8 coupons is full.
+			if lgArr != dsLgInitListSize {
+				return nil, fmt.Errorf("%w: LIST with lgArr %d", ErrMalformed, lgArr)
+			}
+			count = 1 << lgArr
+		}
+		return h, h.setDataSketchesCoupons(data[dsListIntArrStart:], count, lgK)
+	case mode == dsModeSet && preInts == dsSetPreInts:
+		if len(data) < dsSetIntArrStart {
+			return nil, fmt.Errorf("%w: sketch too short", ErrMalformed)
+		}
+		count := int(binary.LittleEndian.Uint32(data[8:]))
+		if !compact {
+			// A SET grows from 32 coupons up to k/8, see MarshalDataSketches.
+			if lgK < 8 || lgArr < dsLgInitSetSize || lgArr > lgK-3 {
+				return nil, fmt.Errorf("%w: SET with lgK %d and lgArr %d", ErrMalformed, lgK, lgArr)
+			}
+			count = 1 << lgArr
+		}
+		return h, h.setDataSketchesCoupons(data[dsSetIntArrStart:], count, lgK)
+	case mode == dsModeHll && preInts == dsHllPreInts:
+		if len(data) < dsHllByteArrStart {
+			return nil, fmt.Errorf("%w: sketch too short", ErrMalformed)
+		}
+		return h, h.setDataSketchesRegisters(data, tgtType, compact)
+	}
+	return nil, fmt.Errorf("%w: mode %d with %d preamble ints", ErrMalformed, mode, preInts)
+}
+
+// setDataSketchesCoupons adds count coupons from data. Empty slots in non compact arrays are zero.
+func (h *Hll) setDataSketchesCoupons(data []byte, count int, lgK uint8) error {
+	if lgK > dsKeyBits || count > len(data)/4 {
+		return fmt.Errorf("%w: %d coupons don't fit in %d bytes", ErrCorruptSparse, count, len(data))
+	}
+
+	for i := 0; i < count; i++ {
+		coupon := binary.LittleEndian.Uint32(data[i*4:])
+		if coupon == 0 {
+			continue
+		}
+		slot, r := coupon&dsKeyMask, uint8(coupon>>dsKeyBits)
+		if r == 0 {
+			return fmt.Errorf("%w: invalid coupon %#x", ErrCorruptSparse, coupon)
+		}
+		h.addHash(dataSketchesCouponToHash(slot, r, uint(lgK)))
+	}
+
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+// dataSketchesCouponToHash converts a coupon into a hash with the same register and value. The
+// slot bits that aren't part of the register index are stored after the bit that determines rhoW.
+// That way different coupons for the same register remain different sparse elements.
+func dataSketchesCouponToHash(slot uint32, r uint8, p uint) uint64 {
+	idx := uint64(slot) & (1<<p - 1)
+	extra := uint64(slot) >> p
+	extraBits := dsKeyBits - p
+
+	x := decodeNormalToHash(idx, r, p)
+	if uint(r) >= 64-p {
+		return x
+	}
+	if rest := 64 - p - uint(r); rest >= extraBits {
+		x |= extra << (rest - extraBits)
+	} else {
+		x |= extra >> (extraBits - rest)
+	}
+	return x
+}
+
+func (h *Hll) setDataSketchesRegisters(data []byte, tgtType DataSketchesType, compact bool) error {
+	lgK, lgArr, curMin := uint(data[3]), data[4], data[6]
+	auxCount := int(binary.LittleEndian.Uint32(data[36:]))
+	data = data[dsHllByteArrStart:]
+
+	var size int
+	switch tgtType {
+	case DataSketchesHLL4:
+		size = int(h.m / 2)
+	case DataSketchesHLL6:
+		size = int(h.m*3/4) + 1
+	case DataSketchesHLL8:
+		size = int(h.m)
+	}
+	if len(data) < size {
+		return fmt.Errorf("%w: expected %d bytes of registers, got %d", ErrCorruptDense, size, len(data))
+	}
+
+	maxRhoW := uint8(64 - h.p + 1)
+	h.switchToNormal()
+
+	for i := uint64(0); i < h.m; i++ {
+		var r uint8
+		switch tgtType {
+		case DataSketchesHLL4:
+			r = data[i/2]
+			if i&1 != 0 {
+				r >>= 4
+			}
+			r &= 0xf
+			if r == dsAuxToken {
+				// The value is in the exception table.
+				continue
+			}
+			if int(r)+int(curMin) > int(maxRhoW) {
+				return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, int(r)+int(curMin))
+			}
+			r += curMin
+		case DataSketchesHLL6:
+			b := i * 6 / 8
+			r = uint8((uint16(data[b])|uint16(data[b+1])<<8)>>(i*6%8)) & 0x3f
+		case DataSketchesHLL8:
+			r = data[i]
+		}
+		if r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+		h.bigM.Set(i, r)
+	}
+
+	if tgtType != DataSketchesHLL4 {
+		return nil
+	}
+
+	// The HLL_4 exception table, either compact or a hash table where empty slots are zero.
+	data = data[size:]
+	count := auxCount
+	if !compact {
+		count = 1 << lgArr
+	}
+	if lgArr > dsKeyBits || count > len(data)/4 {
+		return fmt.Errorf("%w: %d exceptions don't fit in %d bytes", ErrCorruptDense, count, len(data))
+	}
+	for i := 0; i < count; i++ {
+		pair := binary.LittleEndian.Uint32(data[i*4:])
+		if pair == 0 {
+			continue
+		}
+		slot, r := uint64(pair&dsKeyMask), uint8(pair>>dsKeyBits)
+		if slot >= 1<<lgK || r > maxRhoW {
+			return fmt.Errorf("%w: invalid exception %#x", ErrCorruptDense, pair)
+		}
+		h.bigM.Set(slot, maxU8(h.bigM.Get(slot), r))
+	}
+	return nil
+}
+
+// MarshalDataSketches encodes the Hll as an Apache DataSketches HLL sketch with the given target
+// register layout. Like DataSketches, sparse sketches are stored as a LIST or SET of coupons and
+// dense sketches use the target layout.
+//
+// The slot of a coupon has 26 bits, the bits after p that are stored in the sparse index are used
+// for the part of the slot that isn't the register index. Register values are identical but
+// coupons won't match the ones DataSketches would have produced for the same input. The HIP
+// estimator state can't be reproduced so the sketch is marked as out of order, which makes
+// DataSketches use its composite estimator instead.
+func (h *Hll) MarshalDataSketches(tgtType DataSketchesType) ([]byte, error) {
+	if tgtType > DataSketchesHLL8 {
+		return nil, fmt.Errorf("unsupported target type %d", tgtType)
+	}
+
+	h.mergeTmpSetIfAny()
+
+	lgK := uint8(h.p)
+	header := []byte{dsListPreInts, dsSerVer, dsFamily, lgK, 0, dsFlagCompact, 0, byte(tgtType) << 2}
+
+	if h.isSparse {
+		coupons := h.dataSketchesCoupons()
+		count := len(coupons)
+
+		// DataSketches promotes a LIST to a SET once it holds 8 coupons, and promotes a SET to HLL
+		// once it is 3/4 full at its maximum size of k/8. Sketches with a lgK below 8 go from LIST to
+		// HLL directly.
+		switch {
+		case count == 0:
+			header[4] = dsLgInitListSize
+			header[5] |= dsFlagEmpty
+			return header, nil
+		case count < 1<<dsLgInitListSize:
+			header[4] = dsLgInitListSize
+			header[6] = byte(count)
+			return appendCoupons(header, coupons), nil
+		case lgK >= 8 && count*4 <= 3*(1<<(lgK-3)):
+			lgArr := uint8(dsLgInitSetSize)
+			for count*4 > 3*(1<<lgArr) {
+				lgArr++
+			}
+			header[0], header[4], header[7] = dsSetPreInts, lgArr, header[7]|dsModeSet
+			header = append(header, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(header[8:], uint32(count))
+			return appendCoupons(header, coupons), nil
+		}
+	}
+
+	registers := h.bigM
+	if h.isSparse {
+		registers = toNormal(h.sparseList, h.p, h.pPrime)
+	}
+
+	// Only HLL_4 stores registers relative to the minimum, the other types always use 0.
+	curMin := uint8(0)
+	if tgtType == DataSketchesHLL4 {
+		curMin = math.MaxUint8
+		for i := uint64(0); i < h.m; i++ {
+			curMin = minU8(curMin, registers.Get(i))
+		}
+	}
+
+	numAtCurMin := 0
+	var kxq0, kxq1 float64
+	for i := uint64(0); i < h.m; i++ {
+		r := registers.Get(i)
+		if r == curMin {
+			numAtCurMin++
+		}
+		if r < 32 {
+			kxq0 += 1 / lookupTable[r]
+		} else {
+			kxq1 += 1 / lookupTable[r]
+		}
+	}
+
+	var data, aux []byte
+	switch tgtType {
+	case DataSketchesHLL4:
+		data = make([]byte, h.m/2)
+		for i := uint64(0); i < h.m; i++ {
+			nibble := registers.Get(i) - curMin
+			if nibble >= dsAuxToken {
+				nibble = dsAuxToken
+				aux = appendUint32(aux, uint32(registers.Get(i))<<dsKeyBits|uint32(i))
+			}
+			data[i/2] |= nibble << (4 * (i & 1))
+		}
+	case DataSketchesHLL6:
+		data = make([]byte, h.m*3/4+1)
+		for i := uint64(0); i < h.m; i++ {
+			v := uint16(registers.Get(i)) << (i * 6 % 8)
+			data[i*6/8] |= byte(v)
+			data[i*6/8+1] |= byte(v >> 8)
+		}
+	case DataSketchesHLL8:
+		data = make([]byte, h.m)
+		for i := range data {
+			data[i] = registers.Get(uint64(i))
+		}
+	}
+
+	auxCount := len(aux) / 4
+	lgArr := uint8(0)
+	if tgtType == DataSketchesHLL4 {
+		lgArr = lgAuxArrInts[lgK]
+		for auxCount*4 > 3*(1<<lgArr) {
+			lgArr++
+		}
+	}
+
+	header[0], header[4], header[5], header[6] = dsHllPreInts, lgArr, dsFlagCompact|dsFlagOutOfOrder, curMin
+	header[7] |= dsModeHll
+	header = append(header, make([]byte, dsHllByteArrStart-len(header))...)
+	binary.LittleEndian.PutUint64(header[8:], math.Float64bits(float64(h.Cardinality())))
+	binary.LittleEndian.PutUint64(header[16:], math.Float64bits(kxq0))
+	binary.LittleEndian.PutUint64(header[24:], math.Float64bits(kxq1))
+	binary.LittleEndian.PutUint32(header[32:], uint32(numAtCurMin))
+	binary.LittleEndian.PutUint32(header[36:], uint32(auxCount))
+
+	return append(append(header, data...), aux...), nil
+}
+
+// dataSketchesCoupons returns the coupons for a sparse Hll, sorted by slot.
+func (h *Hll) dataSketchesCoupons() []uint32 {
+	extraBits := dsKeyBits - h.p
+	rest := h.pPrime - h.p
+
+	slots := make(map[uint32]uint8, h.sparseList.GetNumElements())
+	it := h.sparseList.GetIterator()
+	for {
+		k, ok := it()
+		if !ok {
+			break
+		}
+		idx, r := decodeSparseHashForNormal(k, h.p, h.pPrime)
+
+		// The sparse index bits after the leading one are the extra slot bits, see
+		// dataSketchesCouponToHash.
+		var extra uint64
+		if uint(r) < rest {
+			sparseIdx, _ := decodeSparseHash(k, h.p, h.pPrime)
+			afterOne := rest - uint(r)
+			extra = sparseIdx & (1<<afterOne - 1)
+			if afterOne > extraBits {
+				extra >>= afterOne - extraBits
+			} else {
+				extra <<= extraBits - afterOne
+			}
+		}
+
+		slot := uint32(extra<<h.p | idx)
+		slots[slot] = maxU8(slots[slot], r)
+	}
+
+	coupons := make([]uint32, 0, len(slots))
+	for slot, r := range slots {
+		coupons = append(coupons, uint32(r)<<dsKeyBits|slot)
+	}
+	sort.Slice(coupons, func(i, j int) bool {
+		return coupons[i]&dsKeyMask < coupons[j]&dsKeyMask
+	})
+	return coupons
+}
+
+func appendCoupons(data []byte, coupons []uint32) []byte {
+	for _, c := range coupons {
+		data = appendUint32(data, c)
+	}
+	return data
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	return append(data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func minU8(x, y uint8) uint8 {
+	if x <= y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,146 @@
+package hll
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDataSketches_List(t *testing.T) {
+	// A compact LIST sketch with lgK 12 and two coupons: slot 5 with value 3 and slot 0x123456 with
+	// value 1. The second slot is register 0x456.
+	data := []byte{
+		2, 1, 7, 12, 3, 8, 2, 0,
+		0x05, 0x00, 0x00, 0x0c,
+		0x56, 0x34, 0x12, 0x04,
+	}
+
+	h, err := NewHllFromDataSketches(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.p != 12 || h.pPrime != DataSketchesPPrime {
+		t.Errorf("expected p 12 and pPrime %d got %d and %d", DataSketchesPPrime, h.p, h.pPrime)
+	}
+	if c := h.Cardinality(); c != 2 {
+		t.Errorf("expected cardinality 2 got %d", c)
+	}
+
+	M := registers(h)
+	if M.Get(5) != 3 || M.Get(0x456) != 1 {
+		t.Errorf("expected registers 3 and 1 got %d and %d", M.Get(5), M.Get(0x456))
+	}
+}
+
+func TestDataSketches_HLL4Exceptions(t *testing.T) {
+	// lgK 4 with curMin 1, register 3 in the exception table with value 20.
+	data := make([]byte, 40, 48)
+	copy(data, []byte{10, 1, 7, 4, 2, 8, 1, 2})
+	data[36] = 1
+	data = append(data, 0x10, 0xf0, 0, 0, 0, 0, 0, 0x22)
+	data = append(data, 3, 0, 0, 20<<2)
+
+	h, err := NewHllFromDataSketches(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint8{1, 2, 1, 20, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 3, 3}
+	M := registers(h)
+	for i, r := range expected {
+		if got := M.Get(uint64(i)); got != r {
+			t.Errorf("register %d: expected %d got %d", i, r, got)
+		}
+	}
+}
+
+func TestDataSketches_RoundTrip(t *testing.T) {
+	for _, p := range []uint{4, 10, 14} {
+		for _, n := range []int{0, 5, 100, 1000, 100000} {
+			for _, typ := range []DataSketchesType{DataSketchesHLL4, DataSketchesHLL6, DataSketchesHLL8} {
+				t.Run(fmt.Sprintf("p%d-%d-HLL%d", p, n, 4+2*typ), func(t *testing.T) {
+					h := NewHll(p, DataSketchesPPrime)
+					for i := 0; i < n; i++ {
+						h.Add(rand.Uint64())
+					}
+
+					data, err := h.MarshalDataSketches(typ)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					h2, err := NewHllFromDataSketches(data)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					M, M2 := registers(h), registers(h2)
+					for i := uint64(0); i < h.m; i++ {
+						if M.Get(i) != M2.Get(i) {
+							t.Fatalf("register %d: expected %d got %d", i, M.Get(i), M2.Get(i))
+						}
+					}
+
+					// DataSketches switches to HLL mode sooner than we switch to a dense representation.
+					if data[7]&3 != dsModeHll && !h2.isSparse {
+						t.Errorf("expected a sparse sketch for a LIST or SET")
+					}
+					if data[7]&3 != dsModeHll {
+						data2, err := h2.MarshalDataSketches(typ)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !bytes.Equal(data, data2) {
+							t.Errorf("expected the same coupons after a round trip")
+						}
+					}
+					if !h.isSparse && h.Cardinality() != h2.Cardinality() {
+						t.Errorf("expected cardinality %d got %d", h.Cardinality(), h2.Cardinality())
+					}
+				})
+			}
+		}
+	}
+}
+
+// dataSketchesHll returns a compact HLL mode sketch with the given registers and no exceptions.
+func dataSketchesHll(lgK uint8, tgtType DataSketchesType, curMin uint8, registers []byte) []byte {
+	data := make([]byte, dsHllByteArrStart, dsHllByteArrStart+len(registers))
+	copy(data, []byte{dsHllPreInts, dsSerVer, dsFamily, lgK, 0, dsFlagCompact, curMin, byte(tgtType)<<2 | dsModeHll})
+	return append(data, registers...)
+}
+
+func TestDataSketches_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short", []byte{2, 1, 7}, ErrMalformed},
+		{"family", []byte{2, 1, 3, 12, 3, 8, 0, 0}, ErrUnsupportedType},
+		{"version", []byte{2, 2, 7, 12, 3, 8, 0, 0}, ErrUnsupportedVersion},
+		{"lgK", []byte{2, 1, 7, 21, 3, 8, 0, 0}, ErrBadPrecision},
+		{"mode", []byte{3, 1, 7, 12, 3, 8, 0, 0}, ErrMalformed},
+		{"coupons", []byte{2, 1, 7, 12, 3, 8, 2, 0, 1, 0, 0, 4}, ErrCorruptSparse},
+		{"coupon value", []byte{2, 1, 7, 12, 3, 8, 1, 0, 1, 0, 0, 0}, ErrCorruptSparse},
+		{"registers", append([]byte{10, 1, 7, 4, 0, 8, 0, 10}, make([]byte, 40)...), ErrCorruptDense},
+		{"list lgArr", append([]byte{2, 1, 7, 12, 63, 0, 0, 0}, make([]byte, 32)...), ErrMalformed},
+		{"set lgArr", append([]byte{3, 1, 7, 12, 64, 0, 0, 1}, make([]byte, 4)...), ErrMalformed},
+		{"set lgArr above lgK", append([]byte{3, 1, 7, 12, 10, 0, 0, 1}, make([]byte, 4100)...), ErrMalformed},
+		{"set small lgK", append([]byte{3, 1, 7, 7, 5, 0, 0, 1}, make([]byte, 132)...), ErrMalformed},
+		{"HLL_4 curMin", dataSketchesHll(4, 0, 62, make([]byte, 8)), ErrCorruptDense},
+		{"HLL_6 register", dataSketchesHll(4, 1, 0, append([]byte{0x3f}, make([]byte, 12)...)), ErrCorruptDense},
+		{"HLL_8 register", dataSketchesHll(4, 2, 0, append([]byte{0x41}, make([]byte, 15)...)), ErrCorruptDense},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewHllFromDataSketches(test.data); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+}
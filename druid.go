@@ -0,0 +1,171 @@
+package hll
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// DruidP is the precision of Druid HyperLogLogCollectors, which always have 2048 buckets. Sketches
+// created by NewHllFromDruid also use it as pPrime.
+const DruidP = 11
+
+// The format is implemented in HyperLogLogCollector.java and VersionOneHyperLogLogCollector.java.
+// See: https://github.com/apache/druid/tree/master/processing/src/main/java/org/apache/druid/hll
+const (
+	druidVersion    = 1
+	druidHeaderSize = 7
+	druidBuckets    = 1 << DruidP
+	druidDenseSize  = druidHeaderSize + druidBuckets/2
+
+	druidMaxDelta       = 15
+	druidMaxPosition    = 64 // The highest positionOf1 Druid can compute from 8 bytes.
+	druidDenseThreshold = 128
+)
+
+// DruidHash hashes a string the same way the hyperUnique aggregator does, using the 128 bit murmur3
+// hash of the UTF-8 bytes. The result is rearranged so that adding it to an Hll with p 11 updates
+// the same register as in Druid.
+func DruidHash(s string) uint64 {
+	return DruidHashBytes([]byte(s))
+}
+
+// DruidHashBytes is the same as DruidHash but for a byte slice.
+func DruidHashBytes(b []byte) uint64 {
+	h1, h2 := murmur3Sum128(b, 0)
+
+	// Druid takes the bucket from the last two bytes of the hash and the position of the first one
+	// bit from the first eight bytes, starting at the least significant bit.
+	bucket := (h2>>48&0x7)<<8 | h2>>56
+	return bucket<<(64-DruidP) | bits.Reverse64(h1)>>DruidP
+}
+
+// NewHllFromDruid decodes a version 1 Druid HyperLogLogCollector in either its sparse or dense form.
+// The resulting Hll has p and pPrime DruidP.
+//
+// Druid only keeps the highest register that didn't fit in 4 bits. Other registers that overflowed
+// were already lost in Druid and are imported as the highest value that did fit.
+func NewHllFromDruid(data []byte) (*Hll, error) {
+	if len(data) < druidHeaderSize {
+		return nil, fmt.Errorf("%w: collector too short", ErrMalformed)
+	}
+	if data[0] != druidVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
+
+	offset := data[1]
+	maxOverflowValue := data[4]
+	maxOverflowRegister := uint64(binary.BigEndian.Uint16(data[5:]))
+
+	if offset > druidMaxPosition || maxOverflowValue > druidMaxPosition || maxOverflowRegister >= druidBuckets {
+		return nil, fmt.Errorf("%w: invalid header", ErrMalformed)
+	}
+
+	// Expand the sparse form, which consists of the absolute position and value of every byte that
+	// isn't zero.
+	dense := data
+	if len(data) != druidDenseSize {
+		if (len(data)-druidHeaderSize)%3 != 0 {
+			return nil, fmt.Errorf("%w: %d bytes is neither sparse nor dense", ErrMalformed, len(data))
+		}
+
+		dense = make([]byte, druidDenseSize)
+		for i := druidHeaderSize; i < len(data); i += 3 {
+			position := int(binary.BigEndian.Uint16(data[i:]))
+			if position < druidHeaderSize || position >= druidDenseSize {
+				return nil, fmt.Errorf("%w: position %d out of range", ErrCorruptSparse, position)
+			}
+			dense[position] = data[i+2]
+		}
+	}
+
+	h := NewHll(DruidP, DruidP)
+	maxRhoW := uint8(64 - DruidP + 1)
+
+	for i := uint64(0); i < druidBuckets; i++ {
+		// Even buckets are stored in the high nibble.
+		r := dense[druidHeaderSize+i/2] >> (4 * (1 - i&1)) & 0xf
+
+		// Once every bucket is filled Druid increases the offset and decreases all buckets. A bucket
+		// with offset 0 is empty, otherwise it is equal to the offset.
+		r += offset
+		if i == maxOverflowRegister {
+			r = maxU8(r, maxOverflowValue)
+		}
+		if r > 0 {
+			h.addHash(decodeNormalToHash(i, minU8(r, maxRhoW), DruidP))
+		}
+	}
+
+	h.mergeTmpSetIfAny()
+	return h, nil
+}
+
+// MarshalDruid encodes the Hll as a version 1 Druid HyperLogLogCollector, which can be used as the
+// value of a hyperUnique column.
+//
+// Druid always uses 2048 buckets, an Hll with a higher p is downsampled which makes it less precise.
+// A lower p can't be converted and results in an error. Druid stores buckets as 4 bit values
+// relative to the lowest bucket plus one overflow bucket. Other buckets that don't fit are stored
+// as the highest value that does, this makes the estimate of very large cardinalities lower.
+func (h *Hll) MarshalDruid() ([]byte, error) {
+	if h.p < DruidP {
+		return nil, fmt.Errorf("precision %d is lower than the Druid precision %d", h.p, DruidP)
+	}
+
+	d := h
+	if h.p > DruidP {
+		var err error
+		if d, err = h.Downsample(DruidP, DruidP); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mergeTmpSetIfAny()
+
+	registers := d.bigM
+	if d.isSparse {
+		registers = toNormal(d.sparseList, d.p, d.pPrime)
+	}
+
+	offset := uint8(math.MaxUint8)
+	for i := uint64(0); i < druidBuckets; i++ {
+		offset = minU8(offset, registers.Get(i))
+	}
+
+	data := make([]byte, druidDenseSize)
+	data[0], data[1] = druidVersion, offset
+
+	nonZero := 0
+	maxOverflowValue, maxOverflowRegister := uint8(0), uint64(0)
+	for i := uint64(0); i < druidBuckets; i++ {
+		r := registers.Get(i)
+		if r-offset > druidMaxDelta && r > maxOverflowValue {
+			maxOverflowValue, maxOverflowRegister = r, i
+		}
+
+		delta := minU8(r-offset, druidMaxDelta)
+		if delta > 0 {
+			nonZero++
+		}
+		data[druidHeaderSize+i/2] |= delta << (4 * (1 - i&1))
+	}
+
+	binary.BigEndian.PutUint16(data[2:], uint16(nonZero))
+	data[4] = maxOverflowValue
+	binary.BigEndian.PutUint16(data[5:], uint16(maxOverflowRegister))
+
+	// Druid switches to the dense form long before the offset is increased.
+	if offset > 0 || nonZero >= druidDenseThreshold {
+		return data, nil
+	}
+
+	sparse := data[:druidHeaderSize:druidHeaderSize]
+	for i := druidHeaderSize; i < druidDenseSize; i++ {
+		if data[i] != 0 {
+			sparse = append(sparse, byte(i>>8), byte(i), data[i])
+		}
+	}
+	return sparse, nil
+}
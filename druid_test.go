@@ -0,0 +1,163 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// druidRegister is a direct translation of HyperLogLogCollector.add(byte[]) using the byte order of
+// Guava's HashCode.asBytes.
+func druidRegister(s string) (bucket uint64, positionOf1 uint8) {
+	h1, h2 := murmur3Sum128([]byte(s), 0)
+
+	hashed := make([]byte, 16)
+	binary.LittleEndian.PutUint64(hashed, h1)
+	binary.LittleEndian.PutUint64(hashed[8:], h2)
+
+	bucket = uint64(binary.BigEndian.Uint16(hashed[14:]) & 0x7ff)
+	for i := 0; i < 8; i++ {
+		for j := uint8(0); j < 8; j++ {
+			if hashed[i]>>j&1 != 0 {
+				return bucket, uint8(i)*8 + j + 1
+			}
+		}
+	}
+	return bucket, 0
+}
+
+func TestDruid_Hash(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		s := strconv.Itoa(i)
+
+		h := NewHll(DruidP, DruidP)
+		h.Add(DruidHash(s))
+
+		bucket, positionOf1 := druidRegister(s)
+		if r := registers(h).Get(bucket); r != positionOf1 {
+			t.Fatalf("%s: expected register %d to be %d got %d", s, bucket, positionOf1, r)
+		}
+	}
+}
+
+func TestDruid_Sparse(t *testing.T) {
+	// Bucket 0 is 3, bucket 3 is 1 and bucket 100 overflowed with 20.
+	data := []byte{
+		1, 0, 0, 3, 20, 0, 100,
+		0, 7, 0x30,
+		0, 8, 0x01,
+		0, 57, 0xf0,
+	}
+
+	h, err := NewHllFromDruid(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	M := registers(h)
+	for i, expected := range map[uint64]uint8{0: 3, 1: 0, 2: 0, 3: 1, 100: 20, 101: 0} {
+		if r := M.Get(i); r != expected {
+			t.Errorf("register %d: expected %d got %d", i, expected, r)
+		}
+	}
+
+	out, err := h.MarshalDruid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("expected %x got %x", data, out)
+	}
+}
+
+func TestDruid_Offset(t *testing.T) {
+	h := NewHll(DruidP, DruidP)
+	h.switchToNormal()
+	for i := uint64(0); i < druidBuckets; i++ {
+		h.bigM.Set(i, 5)
+	}
+	h.bigM.Set(7, 20)
+	h.bigM.Set(8, 30)
+	h.bigM.Set(9, 25)
+
+	data, err := h.MarshalDruid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != druidDenseSize || data[1] != 5 || data[4] != 30 {
+		t.Fatalf("expected a dense collector with offset 5 and overflow 30")
+	}
+
+	h2, err := NewHllFromDruid(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	M := registers(h2)
+	for i, expected := range map[uint64]uint8{0: 5, 7: 20, 8: 30, 9: 20, 2047: 5} {
+		if r := M.Get(i); r != expected {
+			t.Errorf("register %d: expected %d got %d", i, expected, r)
+		}
+	}
+}
+
+func TestDruid_RoundTrip(t *testing.T) {
+	for _, p := range []uint{11, 14} {
+		for _, n := range []int{0, 10, 1000, 100000} {
+			t.Run(fmt.Sprintf("p%d-%d", p, n), func(t *testing.T) {
+				h := NewHll(p, 25)
+				for i := 0; i < n; i++ {
+					h.Add(rand.Uint64())
+				}
+
+				data, err := h.MarshalDruid()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				h2, err := NewHllFromDruid(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expected, err := h.Downsample(DruidP, DruidP)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if expected.Cardinality() != h2.Cardinality() {
+					t.Errorf("expected cardinality %d got %d", expected.Cardinality(), h2.Cardinality())
+				}
+			})
+		}
+	}
+}
+
+func TestDruid_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short", []byte{1, 0, 0}, ErrMalformed},
+		{"version", []byte{0, 0, 0, 0, 0, 0, 0}, ErrUnsupportedVersion},
+		{"overflow register", []byte{1, 0, 0, 0, 0, 0x08, 0}, ErrMalformed},
+		{"size", []byte{1, 0, 0, 0, 0, 0, 0, 0}, ErrMalformed},
+		{"position", []byte{1, 0, 0, 1, 0, 0, 0, 0, 6, 1}, ErrCorruptSparse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewHllFromDruid(test.data); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, err := NewHll(10, 25).MarshalDruid(); err == nil {
+		t.Errorf("expected an error for p 10")
+	}
+}
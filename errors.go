@@ -0,0 +1,15 @@
+package hll
+
+import "errors"
+
+// Errors returned when decoding a serialized sketch. They are wrapped with more details, use
+// errors.Is to check for them.
+var (
+	ErrMalformed          = errors.New("malformed sketch")
+	ErrUnsupportedType    = errors.New("unsupported sketch type")
+	ErrUnsupportedVersion = errors.New("unsupported encoding version")
+	ErrBadPrecision       = errors.New("bad precision")
+	ErrCorruptSparse      = errors.New("corrupt sparse data")
+	ErrCorruptDense       = errors.New("corrupt dense data")
+	ErrChecksum           = errors.New("checksum mismatch")
+)
@@ -1,10 +1,16 @@
 module github.com/erikdubbelboer/hll
 
-go 1.14
+go 1.22
 
 require (
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869
-	github.com/golang/protobuf v1.3.5
+	github.com/golang/protobuf v1.5.4
 	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.18.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
 	github.com/kr/pretty v0.2.0 // indirect
+	github.com/kr/text v0.1.0 // indirect
 )
@@ -0,0 +1,194 @@
+package hll
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Hasher hashes the values added with AddString, AddBytes, AddUint64Value and AddComposite. The
+// name of the hasher is stored in encoded sketches, Combine refuses to combine sketches with
+// different hashers. Custom hashers have to be registered with RegisterHasher before sketches using
+// them can be decoded.
+type Hasher interface {
+	// Name identifies the hash function. It must not change once sketches are stored. It can be at
+	// most 255 bytes and can't contain spaces.
+	Name() string
+	HashBytes(b []byte) uint64
+	HashUint64(v uint64) uint64
+}
+
+// The built-in hashers, they are registered by default.
+var (
+	// ZetaSketchHasher hashes values the same way as ZetaSketch and BigQuery, see BigQueryHash.
+	ZetaSketchHasher Hasher = zetaSketchHasher{}
+	// XXHash64Hasher is XXH64 with seed 0. Integers are hashed as 8 bytes little endian.
+	XXHash64Hasher Hasher = xxhash64Hasher{}
+	// Murmur3Hasher is the first half of MurmurHash3_x64_128 with seed 0, the same as airlift. See
+	// AirliftHash.
+	Murmur3Hasher Hasher = murmur3Hasher{}
+)
+
+// DefaultHasher is used by the Add methods of an Hll that wasn't created with WithHasher.
+var DefaultHasher = XXHash64Hasher
+
+// maxHasherName is the maximum length of a hasher name, to limit what decoders have to read.
+const maxHasherName = 255
+
+var hashers = struct {
+	sync.RWMutex
+	byName map[string]Hasher
+}{
+	byName: map[string]Hasher{},
+}
+
+func init() {
+	for _, h := range []Hasher{ZetaSketchHasher, XXHash64Hasher, Murmur3Hasher} {
+		if err := RegisterHasher(h); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterHasher makes a hasher known to the decoders. It returns an error if the name is invalid
+// or already registered.
+func RegisterHasher(h Hasher) error {
+	name := h.Name()
+	if err := checkHasherName(name); err != nil {
+		return err
+	}
+
+	hashers.Lock()
+	defer hashers.Unlock()
+
+	if _, ok := hashers.byName[name]; ok {
+		return fmt.Errorf("hasher %q is already registered", name)
+	}
+	hashers.byName[name] = h
+	return nil
+}
+
+// LookupHasher returns the registered hasher with the given name.
+func LookupHasher(name string) (Hasher, bool) {
+	hashers.RLock()
+	defer hashers.RUnlock()
+
+	h, ok := hashers.byName[name]
+	return h, ok
+}
+
+func checkHasherName(name string) error {
+	if name == "" || len(name) > maxHasherName {
+		return fmt.Errorf("hasher name must be between 1 and %d bytes, got %q", maxHasherName, name)
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) || unicode.IsSpace(r) }) >= 0 {
+		return fmt.Errorf("hasher name can't contain spaces, got %q", name)
+	}
+	return nil
+}
+
+// lookupHasher is LookupHasher for decoders, an empty name means the hasher isn't known.
+func lookupHasher(name string) (Hasher, error) {
+	if name == "" {
+		return nil, nil
+	}
+	h, ok := LookupHasher(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: hasher %q isn't registered", ErrUnsupportedType, name)
+	}
+	return h, nil
+}
+
+// hasherName returns the name of h, or an empty string if h is nil.
+func hasherName(h Hasher) string {
+	if h == nil {
+		return ""
+	}
+	return h.Name()
+}
+
+// Hasher returns the hasher set with WithHasher, or nil if it isn't known. An Hll that used one of
+// the Add methods without a hasher uses DefaultHasher from then on.
+func (h *Hll) Hasher() Hasher {
+	return h.hasher
+}
+
+func (h *Hll) valueHasher() Hasher {
+	if h.hasher == nil {
+		h.hasher = DefaultHasher
+	}
+	return h.hasher
+}
+
+// AddString hashes s with the hasher of the Hll and adds it.
+func (h *Hll) AddString(s string) {
+	h.Add(h.valueHasher().HashBytes([]byte(s)))
+}
+
+// AddBytes hashes b with the hasher of the Hll and adds it.
+func (h *Hll) AddBytes(b []byte) {
+	h.Add(h.valueHasher().HashBytes(b))
+}
+
+// AddUint64Value hashes v with the hasher of the Hll and adds it. Unlike Add, v doesn't have to be
+// a hash already.
+func (h *Hll) AddUint64Value(v uint64) {
+	h.Add(h.valueHasher().HashUint64(v))
+}
+
+// AddComposite adds a key made up of multiple parts, for example the columns of a composite key.
+// Every part is prefixed with its length before hashing, so ("ab", "c") and ("a", "bc") are
+// different keys.
+func (h *Hll) AddComposite(parts ...[]byte) {
+	h.Add(h.valueHasher().HashBytes(CompositeKey(parts...)))
+}
+
+// AddCompositeString is AddComposite for string parts.
+func (h *Hll) AddCompositeString(parts ...string) {
+	b := make([][]byte, len(parts))
+	for i, part := range parts {
+		b[i] = []byte(part)
+	}
+	h.AddComposite(b...)
+}
+
+// CompositeKey returns the key AddComposite hashes for parts. Every part is prefixed with its length
+// as uvarint.
+func CompositeKey(parts ...[]byte) []byte {
+	n := 0
+	for _, part := range parts {
+		n += binary.MaxVarintLen64 + len(part)
+	}
+
+	key := make([]byte, 0, n)
+	for _, part := range parts {
+		key = appendUvarint(key, uint64(len(part)))
+		key = append(key, part...)
+	}
+	return key
+}
+
+type zetaSketchHasher struct{}
+
+func (zetaSketchHasher) Name() string               { return "zetasketch" }
+func (zetaSketchHasher) HashBytes(b []byte) uint64  { return BigQueryHashBytes(b) }
+func (zetaSketchHasher) HashUint64(v uint64) uint64 { return BigQueryHashUint64(v) }
+
+type xxhash64Hasher struct{}
+
+func (xxhash64Hasher) Name() string              { return "xxhash64" }
+func (xxhash64Hasher) HashBytes(b []byte) uint64 { return xxhash64(b, 0) }
+
+func (xxhash64Hasher) HashUint64(v uint64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return xxhash64(b[:], 0)
+}
+
+type murmur3Hasher struct{}
+
+func (murmur3Hasher) Name() string               { return "murmur3" }
+func (murmur3Hasher) HashBytes(b []byte) uint64  { return AirliftHashBytes(b) }
+func (murmur3Hasher) HashUint64(v uint64) uint64 { return AirliftHashInt64(int64(v)) }
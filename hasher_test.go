@@ -0,0 +1,139 @@
+package hll
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestXXHash64(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+
+	for _, testCase := range testCases {
+		if actual := xxhash64([]byte(testCase.in), 0); actual != testCase.expected {
+			t.Errorf("%q: expected %#x, got %#x", testCase.in, testCase.expected, actual)
+		}
+	}
+}
+
+func TestHasherAdd(t *testing.T) {
+	h, err := New(WithHasher(ZetaSketchHasher))
+	assert.Equal(t, nil, err)
+	h.AddString("foo")
+	h.AddBytes([]byte("bar"))
+	h.AddUint64Value(42)
+
+	expected, _ := New(WithHasher(ZetaSketchHasher))
+	expected.Add(BigQueryHash("foo"))
+	expected.Add(BigQueryHashBytes([]byte("bar")))
+	expected.Add(BigQueryHashUint64(42))
+	assert.Equal(t, expected.Dump(), h.Dump())
+
+	// Without a hasher the default is used and remembered.
+	h = NewHll(DefaultP, DefaultPPrime)
+	assert.Equal(t, nil, h.Hasher())
+	h.AddString("foo")
+	assert.Equal(t, DefaultHasher, h.Hasher())
+}
+
+func TestHasherComposite(t *testing.T) {
+	h := NewHll(DefaultP, DefaultPPrime)
+	h.AddCompositeString("ab", "c")
+	h.AddCompositeString("a", "bc")
+	h.AddComposite([]byte("a"), []byte("bc"))
+	assert.Equal(t, uint64(2), h.Cardinality())
+	assert.Equal(t, uint64(3), h.NumValues())
+}
+
+func TestHasherCombine(t *testing.T) {
+	x, _ := New(WithHasher(XXHash64Hasher))
+	m, _ := New(WithHasher(Murmur3Hasher))
+	x.AddString("foo")
+	m.AddString("foo")
+	assert.NotEqual(t, nil, x.Combine(m))
+
+	unknown := NewHll(DefaultP, DefaultPPrime)
+	assert.Equal(t, nil, unknown.Combine(m))
+	assert.Equal(t, Murmur3Hasher, unknown.Hasher())
+	assert.Equal(t, nil, m.Combine(NewHll(DefaultP, DefaultPPrime)))
+	assert.Equal(t, Murmur3Hasher, m.Hasher())
+}
+
+type testHasher struct{}
+
+func (testHasher) Name() string               { return "test" }
+func (testHasher) HashBytes(b []byte) uint64  { return uint64(len(b)) << 40 }
+func (testHasher) HashUint64(v uint64) uint64 { return v }
+
+func TestHasherEncodings(t *testing.T) {
+	type encoding struct {
+		name      string
+		marshal   func(h *Hll) ([]byte, error)
+		unmarshal func(h *Hll, data []byte) error
+	}
+	encodings := []encoding{
+		{"binary", (*Hll).MarshalBinary, (*Hll).UnmarshalBinary},
+		{"pb", (*Hll).MarshalPb, (*Hll).UnmarshalPb},
+		{"json", (*Hll).MarshalJSON, (*Hll).UnmarshalJSON},
+		{"text", func(h *Hll) ([]byte, error) { return []byte(h.Dump()), nil }, (*Hll).UnmarshalText},
+	}
+
+	h, err := New(WithHasher(testHasher{}))
+	assert.Equal(t, nil, err)
+	h.AddString("foo")
+
+	for _, e := range encodings {
+		data, err := e.marshal(h)
+		assert.Equal(t, nil, err)
+
+		err = e.unmarshal(&Hll{}, data)
+		assert.Tf(t, errors.Is(err, ErrUnsupportedType), "%s: %v", e.name, err)
+	}
+
+	assert.Equal(t, nil, RegisterHasher(testHasher{}))
+	defer func() {
+		hashers.Lock()
+		delete(hashers.byName, "test")
+		hashers.Unlock()
+	}()
+
+	for _, e := range encodings {
+		data, err := e.marshal(h)
+		assert.Equal(t, nil, err)
+
+		rt := &Hll{}
+		assert.Equalf(t, nil, e.unmarshal(rt, data), e.name)
+		assert.Equalf(t, Hasher(testHasher{}), rt.Hasher(), e.name)
+		assert.Equalf(t, h.Dump(), rt.Dump(), e.name)
+	}
+}
+
+func TestRegisterHasher(t *testing.T) {
+	assert.NotEqual(t, nil, RegisterHasher(XXHash64Hasher))
+
+	for _, name := range []string{"", "with space", string(make([]byte, 256))} {
+		assert.NotEqual(t, nil, RegisterHasher(namedHasher(name)))
+
+		_, err := New(WithHasher(namedHasher(name)))
+		assert.NotEqual(t, nil, err)
+	}
+
+	h, ok := LookupHasher("zetasketch")
+	assert.T(t, ok)
+	assert.Equal(t, ZetaSketchHasher, h)
+}
+
+type namedHasher string
+
+func (h namedHasher) Name() string             { return string(h) }
+func (namedHasher) HashBytes(b []byte) uint64  { return 0 }
+func (namedHasher) HashUint64(v uint64) uint64 { return 0 }
@@ -1,12 +1,15 @@
 package hll
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math"
 	"sort"
 
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 const (
@@ -25,16 +28,40 @@ func init() {
 	}
 }
 
+// ValueType is the type of the values that were hashed and added to an Hll. Sketches of different
+// value types hash their values differently and can't be combined. The values match ZetaSketch's
+// DefaultOpsType.Id so they can be stored in BigQuery sketches as is.
+type ValueType int32
+
+const (
+	ValueTypeUnknown       ValueType = 0
+	ValueTypeInt32         ValueType = 1
+	ValueTypeInt64         ValueType = 2
+	ValueTypeUint32        ValueType = 3
+	ValueTypeUint64        ValueType = 4
+	ValueTypeFloat         ValueType = 5
+	ValueTypeDouble        ValueType = 6
+	ValueTypeBytesOrString ValueType = 11
+)
+
 type Hll struct {
-	bigM                normal   // M is used for the dense case, and registers the rho values for each hashed index.
-	sparseList          *sparse  // This will be nil if isSparse==false. Used for sparse case for aggregation
-	tempSet             []uint64 // used to store values temporarilty for the sparse case
-	alpha               float64  // constant used in cardinality calculation
-	isSparse            bool     // boolean flag that determines when to switch over to the dense case
-	p, pPrime           uint     // precision bits for dense and sparse cases
-	m, mPrime           uint64   // register sizes for dense and sparse cases
-	mergeSizeBits       uint64   // the limit for the size of the temp set
-	sparseThresholdBits uint64   // the limit for the size of the sparseList, indicates when to switch to dense.
+	bigM                normal    // M is used for the dense case, and registers the rho values for each hashed index.
+	sparseList          *sparse   // This will be nil if isSparse==false. Used for sparse case for aggregation
+	tempSet             []uint64  // used to store values temporarilty for the sparse case
+	alpha               float64   // constant used in cardinality calculation
+	isSparse            bool      // boolean flag that determines when to switch over to the dense case
+	p, pPrime           uint      // precision bits for dense and sparse cases
+	m, mPrime           uint64    // register sizes for dense and sparse cases
+	mergeSizeBits       uint64    // the limit for the size of the temp set
+	sparseThresholdBits uint64    // the limit for the size of the sparseList, indicates when to switch to dense.
+	numValues           uint64    // the total number of values added, including duplicates
+	valueType           ValueType // the type of the values that were added, if known
+	codec               Codec     // the compression used when encoding
+	hasher              Hasher    // the hash function of the values, nil if it isn't known
+
+	// The thresholds set with WithSparseThresholdBits and WithMergeSizeBits, 0 if they weren't set.
+	// They are kept when changing the precision.
+	optSparseThresholdBits, optMergeSizeBits uint64
 }
 
 func (h *Hll) Copy() *Hll {
@@ -52,33 +79,37 @@ func (h *Hll) Copy() *Hll {
 		mPrime:              h.mPrime,
 		mergeSizeBits:       h.mergeSizeBits,
 		sparseThresholdBits: h.sparseThresholdBits,
+		numValues:           h.numValues,
+		valueType:           h.valueType,
+		codec:               h.codec,
+		hasher:              h.hasher,
+
+		optSparseThresholdBits: h.optSparseThresholdBits,
+		optMergeSizeBits:       h.optMergeSizeBits,
 	}
 }
 
 // Initialize a new hyper-log-log struct based on inputs p and p'.
 // Google recommends that p be set to 14, and p' to equal either 20 or 25.
+//
+// NewHll panics if p or pPrime is invalid, use New to get an error instead.
 func NewHll(p, pPrime uint) *Hll {
-	if p < 4 || p > 18 {
-		panic("p must be in the range [4,18]")
+	h, err := New(WithPrecision(p), WithSparsePrecision(pPrime))
+	if err != nil {
+		panic(err)
 	}
+	return h
+}
 
+// newHll returns a sparse Hll with the default thresholds. p and pPrime must be valid.
+func newHll(p, pPrime uint) *Hll {
 	h := &Hll{}
 	h.p = p
 	h.pPrime = pPrime
 	h.m = 1 << h.p
 	h.mPrime = 1 << pPrime
 	h.isSparse = true
-
-	switch h.m {
-	case 16:
-		h.alpha = alpha_16
-	case 32:
-		h.alpha = alpha_32
-	case 64:
-		h.alpha = alpha_64
-	default:
-		h.alpha = 0.7213 / (1.0 + 1.079/float64(h.m))
-	}
+	h.alpha = alphaForM(h.m)
 
 	h.sparseList = newSparse(0)
 	h.tempSet = []uint64{}
@@ -93,12 +124,45 @@ func NewHll(p, pPrime uint) *Hll {
 	return h
 }
 
+// setThresholds applies the thresholds that were set with options. They can't be higher than the
+// size of the registers, which can be smaller than when they were set after lowering the precision.
+func (h *Hll) setThresholds() {
+	if h.optSparseThresholdBits != 0 {
+		h.sparseThresholdBits = minU64(h.optSparseThresholdBits, h.m*6)
+		h.mergeSizeBits = h.sparseThresholdBits / 4
+	}
+	if h.optMergeSizeBits != 0 {
+		h.mergeSizeBits = minU64(h.optMergeSizeBits, h.m*6)
+	}
+}
+
+// alphaForM returns the constant used in the cardinality calculation for m registers.
+func alphaForM(m uint64) float64 {
+	switch m {
+	case 16:
+		return alpha_16
+	case 32:
+		return alpha_32
+	case 64:
+		return alpha_64
+	default:
+		return 0.7213 / (1.0 + 1.079/float64(m))
+	}
+}
+
 // Add takes a hash and updates the cardinality estimation data structures.
 //
 // The input should be a hash of whatever type you're estimating of. For example, if you're
 // estimating the cardinality of a stream of strings, you'd pass the hash of each string to this
 // function.
 func (h *Hll) Add(x uint64) {
+	h.numValues++
+	h.addHash(x)
+}
+
+// addHash adds a hash without counting it as a value. This is used when converting from formats
+// that don't keep track of the number of values.
+func (h *Hll) addHash(x uint64) {
 	if h.isSparse {
 		h.addSparse(x)
 	} else {
@@ -106,24 +170,66 @@ func (h *Hll) Add(x uint64) {
 	}
 }
 
+// NumValues returns the total number of values that were added, including duplicates.
+func (h *Hll) NumValues() uint64 {
+	return h.numValues
+}
+
+// ValueType returns the type of the values that were added, or ValueTypeUnknown if it isn't known.
+func (h *Hll) ValueType() ValueType {
+	return h.valueType
+}
+
+// SetValueType records the type of the values that are added. Combine refuses to combine sketches
+// with different value types. Use ValueTypeInt64 when adding values hashed with BigQueryHashInt64
+// and ValueTypeBytesOrString for BigQueryHash and BigQueryHashBytes.
+func (h *Hll) SetValueType(t ValueType) {
+	h.valueType = t
+}
+
 // Combine() merges two HyperLogLog++ calculations. This allows you to parallelize cardinality
 // estimation: each thread can process a shard of the input, then the results can be merged later to
 // give the cardinality of the entire data set (the union of the shards).
 //
 // WARNING: The "other" parameter may be mutated during this call! It may be converted from a sparse
 // to dense representation, which may affect its space usage and precision. This is a deliberate
-// design decision that helps to minimize memory consumption.
+// design decision that helps to minimize memory consumption. Use Union to leave the inputs
+// untouched.
 //
-// The inputs must have the same p and pPrime or this function will panic.
+// If the inputs have a different p or pPrime the input with the higher precision is downgraded to
+// the lower precision, like BigQuery does. The receiver is downgraded in place, "other" is copied
+// first. An error is returned if both inputs have a known value type and they differ, like
+// ZetaSketch does. An unknown value type is compatible with everything and takes the value type of
+// the other input. The same goes for the hashers.
 // The Google paper doesn't give an algorithm for this operation, but its existence is implied, and
 // the ability to do this combine operation is one of the main benefits of using a HyperLogLog-type
 // algorithm in the first place.
-func (h *Hll) Combine(other *Hll) {
-	if h.p != other.p || h.pPrime != other.pPrime {
-		panic(fmt.Sprintf("Parameter mismatch: p=%d/%d, pPrime=%d/%d", h.p, other.p, h.pPrime,
-			other.pPrime))
+func (h *Hll) Combine(other *Hll) error {
+	if h.valueType != other.valueType && h.valueType != ValueTypeUnknown &&
+		other.valueType != ValueTypeUnknown {
+		return fmt.Errorf("value type mismatch: %d/%d", h.valueType, other.valueType)
+	}
+	if h.hasher != nil && other.hasher != nil && h.hasher.Name() != other.hasher.Name() {
+		return fmt.Errorf("hasher mismatch: %s/%s", h.hasher.Name(), other.hasher.Name())
 	}
 
+	p, pPrime := minUint(h.p, other.p), minUint(h.pPrime, other.pPrime)
+	if h.p != p || h.pPrime != pPrime {
+		h.changePrecision(p, pPrime)
+	}
+	if other.p != p || other.pPrime != pPrime {
+		other = other.Copy()
+		other.changePrecision(p, pPrime)
+	}
+
+	if h.valueType == ValueTypeUnknown {
+		h.valueType = other.valueType
+	}
+	if h.hasher == nil {
+		h.hasher = other.hasher
+	}
+	h.numValues += other.numValues
+
 	other.mergeTmpSetIfAny()
 
 	// If the other Hll is normal (not sparse), then the union will be normal. If this Hll isn't
@@ -154,6 +260,88 @@ func (h *Hll) Combine(other *Hll) {
 			h.bigM.Set(index, maxU8(h.bigM.Get(index), r))
 		}
 	}
+
+	return nil
+}
+
+// Downsample returns a copy of the Hll with its precision lowered to p and pPrime. The result is
+// the same as if all values had been added to an Hll created with NewHll(p, pPrime). This can be
+// used to shrink stored sketches without having access to the original data.
+//
+// Neither p nor pPrime can be higher than the current precision, use Upgrade to increase p.
+func (h *Hll) Downsample(p, pPrime uint) (*Hll, error) {
+	if p < 4 || p > h.p {
+		return nil, fmt.Errorf("p must be in the range [4,%d]", h.p)
+	}
+	if pPrime < p || pPrime > h.pPrime {
+		return nil, fmt.Errorf("pPrime must be in the range [%d,%d]", p, h.pPrime)
+	}
+
+	d := h.Copy()
+	d.changePrecision(p, pPrime)
+	return d, nil
+}
+
+// Upgrade returns a copy of the Hll with p increased, up to pPrime. This is only possible while the
+// Hll is still sparse as the sparse list stores a pPrime bit index for every element. It allows a
+// sketch that was created with a low p to gain accuracy once it grows.
+//
+// For elements that were stored without rhoW, because it could be derived from the index at the
+// old p, the rhoW after the pPrime bits is lost. Those elements get the lowest possible rhoW which
+// makes the resulting registers a lower bound. This only affects about 1 in 2^(pPrime-p) elements
+// and doesn't affect the cardinality while the sketch stays sparse.
+func (h *Hll) Upgrade(p uint) (*Hll, error) {
+	if p < h.p || p > h.pPrime || p > MaxP {
+		return nil, fmt.Errorf("p must be in the range [%d,%d]", h.p, minUint(h.pPrime, MaxP))
+	}
+
+	u := h.Copy()
+	u.mergeTmpSetIfAny()
+	if !u.isSparse {
+		return nil, fmt.Errorf("can only upgrade a sparse Hll")
+	}
+
+	u.changePrecision(p, u.pPrime)
+	return u, nil
+}
+
+// changePrecision changes the precision of h to p and pPrime. pPrime must not be higher than the
+// current pPrime and p can only be higher than the current p if h is sparse. Every register or
+// sparse element is turned back into a hash that is re-added at the new precision, this gives the
+// same result as adding the original hashes at the new precision.
+func (h *Hll) changePrecision(p, pPrime uint) {
+	h.mergeTmpSetIfAny()
+
+	d := newHll(p, pPrime)
+	d.numValues = h.numValues
+	d.valueType = h.valueType
+	d.codec = h.codec
+	d.hasher = h.hasher
+	d.optSparseThresholdBits = h.optSparseThresholdBits
+	d.optMergeSizeBits = h.optMergeSizeBits
+	d.setThresholds()
+
+	if h.isSparse {
+		it := h.sparseList.GetIterator()
+		for {
+			k, ok := it()
+			if !ok {
+				break
+			}
+			x := decodeSparseHashToHash(k, h.p, h.pPrime)
+			d.tempSet = append(d.tempSet, uint64(encodeSparseHash(x, p, pPrime)))
+		}
+		d.mergeTmpSetIfAny()
+	} else {
+		d.switchToNormal()
+		for i := uint64(0); i < h.m; i++ {
+			if r := h.bigM.Get(i); r > 0 {
+				d.addNormal(decodeNormalToHash(i, r, h.p))
+			}
+		}
+	}
+
+	*h = *d
 }
 
 func (h *Hll) addSparse(x uint64) {
@@ -228,6 +416,12 @@ func (h *Hll) cardinalityNormal() uint64 {
 			V++
 		}
 	}
+	return h.estimateNormal(inverseSum, V)
+}
+
+// estimateNormal returns the cardinality estimate for registers with the given sum of 2^-register
+// and number of zero registers V. Only p, m and alpha of h are used.
+func (h *Hll) estimateNormal(inverseSum float64, V uint64) uint64 {
 	e1 := h.alpha * float64(h.m*h.m) / inverseSum
 	// Take bias into consideration
 	var e2 float64
@@ -250,24 +444,41 @@ func (h *Hll) cardinalityNormal() uint64 {
 	}
 }
 
-// When marshalling an Hll to JSON, we only marshal a subset of its fields.
+// When marshalling an Hll to JSON, we only marshal a subset of its fields. The sparse list or
+// registers are decoded after the codec is known.
 type jsonableHll struct {
-	BigM       *normal `json:"M,omitempty"`
-	SparseList *sparse `json:"s,omitempty"`
-	P          uint    `json:"p"`
-	PPrime     uint    `json:"pp"`
+	BigM       json.RawMessage `json:"M,omitempty"`
+	SparseList json.RawMessage `json:"s,omitempty"`
+	P          uint            `json:"p"`
+	PPrime     uint            `json:"pp"`
+	NumValues  uint64          `json:"n,omitempty"`
+	ValueType  ValueType       `json:"t,omitempty"`
+	Codec      Codec           `json:"c,omitempty"` // Missing for older versions which always used snappy.
+	Hasher     string          `json:"h,omitempty"`
 }
 
 func (h *Hll) MarshalJSON() ([]byte, error) {
 	// Combine tmpSet with sparse list. This saves serializing the tmpSet, which saves space.
 	h.mergeTmpSetIfAny()
 
-	bigM := &h.bigM
-	if len(*bigM) == 0 {
-		bigM = nil
+	j := &jsonableHll{P: h.p, PPrime: h.pPrime, NumValues: h.numValues, ValueType: h.valueType, Codec: h.encodingCodec()}
+	j.Hasher = hasherName(h.hasher)
+
+	if h.isSparse {
+		s, err := h.sparseList.marshalJSON(j.Codec)
+		if err != nil {
+			return nil, err
+		}
+		j.SparseList = s
+	} else {
+		M, err := h.compressedRegisters(j.Codec)
+		if err != nil {
+			return nil, err
+		}
+		j.BigM = marshalJSONRegisters(M)
 	}
 
-	return json.Marshal(&jsonableHll{bigM, h.sparseList, h.p, h.pPrime})
+	return json.Marshal(j)
 }
 
 func (h *Hll) UnmarshalJSON(buf []byte) error {
@@ -276,71 +487,225 @@ func (h *Hll) UnmarshalJSON(buf []byte) error {
 	if err := json.Unmarshal(buf, &j); err != nil {
 		return err
 	}
+	legacy := j.Codec == CodecDefault
+	if legacy {
+		j.Codec = CodecSnappy
+	}
 
 	// Copy field values from the jsonable model to the real Hll struct.
-	*h = *NewHll(j.P, j.PPrime)
+	d, err := New(WithPrecision(j.P), WithSparsePrecision(j.PPrime))
+	if err != nil {
+		return err
+	}
+	if d.hasher, err = lookupHasher(j.Hasher); err != nil {
+		return err
+	}
+	if (j.SparseList == nil) == (j.BigM == nil) {
+		return fmt.Errorf("%w: expected either sparse or dense data", ErrMalformed)
+	}
+	*h = *d
 	h.sparseList = nil
 	h.bigM = nil
 
-	h.sparseList = j.SparseList
+	if j.SparseList != nil {
+		h.sparseList = &sparse{}
+		if err := h.sparseList.unmarshalJSON(j.SparseList, j.Codec, h.maxSparseSize()); err != nil {
+			return err
+		}
+	}
 	if j.BigM != nil {
-		h.bigM = *j.BigM
+		M, err := unmarshalJSONRegisters(j.BigM)
+		if err != nil {
+			return err
+		}
+
+		// Older versions compressed the packed registers.
+		if legacy {
+			M, err = decompress(CodecSnappy, M, int(h.m*3/4+1))
+			if err == nil {
+				err = h.setNormal(M)
+			}
+		} else {
+			err = h.setCompressedRegisters(j.Codec, M)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	h.isSparse = (h.sparseList != nil)
+	h.numValues = j.NumValues
+	h.valueType = j.ValueType
 	return nil
 }
 
+// maxSparseSize returns the highest number of bytes the sparse list can have. Once it grows beyond
+// the threshold it is converted to the normal representation.
+func (h *Hll) maxSparseSize() int {
+	return int(h.sparseThresholdBits/8) + binary.MaxVarintLen64
+}
+
+// hll_state.pb.go is generated with protoc-gen-go v1.33.0, the version of google.golang.org/protobuf
+// in go.mod. hll.pb.go was generated by protoc-gen-gogo and is kept as is.
+//go:generate protoc --go_out=. --go_opt=paths=source_relative hll_state.proto
+
+// pbVersion is the version of the HllState message written by MarshalPb.
+const pbVersion = 1
+
+// MarshalPb encodes the Hll as a HllState protobuf message, see hll_state.proto.
 func (h *Hll) MarshalPb() ([]byte, error) {
 	h.mergeTmpSetIfAny()
 
-	p, pp := int32(h.p), int32(h.pPrime)
+	pb := &HllState{
+		Version: pbVersion,
+		P:       uint32(h.p),
+		PPrime:  uint32(h.pPrime),
+	}
+	if h.numValues != 0 {
+		pb.NumValues = &h.numValues
+	}
+	if h.valueType != ValueTypeUnknown {
+		t := int32(h.valueType)
+		pb.ValueType = &t
+	}
+	codec := h.encodingCodec()
+	pb.Codec = uint32(codec)
+	pb.Hasher = hasherName(h.hasher)
 
-	pb := &HllPb{}
-	pb.P = &p
-	pb.Pp = &pp
-	pb.M = h.bigM
-	if h.sparseList != nil {
-		pb.S = &HllPbSparse{
-			Buf:         h.sparseList.buf,
-			LastVal:     &h.sparseList.lastVal,
-			NumElements: &h.sparseList.numElements,
+	if h.isSparse {
+		buf, err := compress(codec, h.sparseList.buf)
+		if err != nil {
+			return nil, err
 		}
+		pb.Representation = &HllState_Sparse{Sparse: &HllState_SparseList{
+			Buf:         buf,
+			NumElements: h.sparseList.numElements,
+		}}
+	} else {
+		M, err := h.compressedRegisters(codec)
+		if err != nil {
+			return nil, err
+		}
+		pb.Representation = &HllState_Dense{Dense: M}
 	}
 
 	return proto.Marshal(pb)
 }
 
+// UnmarshalPb decodes a HllState message written by MarshalPb, or a HllPb message written by older
+// versions. HllPb doesn't store the number of values and value type, they are left unknown.
 func (h *Hll) UnmarshalPb(buf []byte) error {
+	isState, err := isHllState(buf)
+	if err != nil {
+		return err
+	}
+	if isState {
+		return h.unmarshalHllState(buf)
+	}
+
 	pb := &HllPb{}
-	err := proto.Unmarshal(buf, pb)
+	if err := proto.Unmarshal(buf, pb); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if pb.P == nil || pb.Pp == nil {
+		return fmt.Errorf("%w: missing p or pp", ErrMalformed)
+	}
+
+	d, err := New(WithPrecision(uint(pb.GetP())), WithSparsePrecision(uint(pb.GetPp())))
 	if err != nil {
 		return err
 	}
 
-	// Copy field values from the protobuf omdel to the real Hll struct.
-	p, pp := uint(*pb.P), uint(*pb.Pp)
+	// The last value is computed from the elements, the stored one isn't needed.
+	switch {
+	case pb.S != nil && pb.M == nil:
+		err = d.setSparseList(pb.S.Buf, pb.S.GetNumElements())
+	case pb.S == nil && pb.M != nil:
+		err = d.setNormal(pb.M)
+	default:
+		err = fmt.Errorf("%w: expected either sparse or dense data", ErrMalformed)
+	}
+	if err != nil {
+		return err
+	}
 
-	*h = *NewHll(p, pp)
-	h.sparseList = nil
-	h.bigM = nil
+	*h = *d
+	return nil
+}
 
-	if pb.S != nil {
-		h.sparseList = &sparse{pb.S.Buf, *pb.S.LastVal, *pb.S.NumElements}
+func (h *Hll) unmarshalHllState(buf []byte) error {
+	pb := &HllState{}
+	if err := proto.Unmarshal(buf, pb); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
 	}
-	if pb.M != nil {
-		h.bigM = pb.M
+	if pb.Version != pbVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, pb.Version)
 	}
 
-	h.isSparse = (h.sparseList != nil)
+	d, err := New(WithPrecision(uint(pb.P)), WithSparsePrecision(uint(pb.PPrime)))
+	if err != nil {
+		return err
+	}
+	d.numValues = pb.GetNumValues()
+	d.valueType = ValueType(pb.GetValueType())
+	if d.hasher, err = lookupHasher(pb.Hasher); err != nil {
+		return err
+	}
+
+	if pb.Codec < uint32(CodecNone) || pb.Codec > uint32(CodecDeflate) {
+		return fmt.Errorf("%w: codec %d", ErrUnsupportedType, pb.Codec)
+	}
+	codec := Codec(pb.Codec)
+
+	var data []byte
+	switch r := pb.Representation.(type) {
+	case *HllState_Sparse:
+		if data, err = decompress(codec, r.Sparse.GetBuf(), d.maxSparseSize()); err == nil {
+			err = d.setSparseList(data, r.Sparse.GetNumElements())
+		}
+	case *HllState_Dense:
+		err = d.setCompressedRegisters(codec, r.Dense)
+	default:
+		err = fmt.Errorf("%w: missing representation", ErrMalformed)
+	}
+	if err != nil {
+		return err
+	}
+
+	*h = *d
 	return nil
 }
 
-// custom gob encoder and decoders
+// isHllState returns whether buf contains a HllState message instead of a HllPb message. HllState
+// only uses field numbers of 16 and higher, HllPb only lower ones.
+func isHllState(buf []byte) (bool, error) {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return false, fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+		}
+		if num >= 16 {
+			return true, nil
+		}
+
+		m := protowire.ConsumeFieldValue(num, typ, buf[n:])
+		if m < 0 {
+			return false, fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(m))
+		}
+		buf = buf[n+m:]
+	}
+	return false, nil
+}
+
+// GobEncode uses the binary encoding of MarshalBinary.
 func (h *Hll) GobEncode() ([]byte, error) {
-	return h.MarshalJSON()
+	return h.MarshalBinary()
 }
 
+// GobDecode accepts the binary encoding and the JSON encoding that older versions used for gob.
 func (h *Hll) GobDecode(data []byte) error {
+	if bytes.HasPrefix(data, binaryMagic) {
+		return h.UnmarshalBinary(data)
+	}
 	return h.UnmarshalJSON(data)
 }
 
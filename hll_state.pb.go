@@ -0,0 +1,338 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.33.0
+// 	protoc        (unknown)
+// source: hll_state.proto
+
+package hll
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// HllState is the protobuf encoding written by MarshalPb. It replaces HllPb in hll.proto, which
+// UnmarshalPb still accepts.
+//
+// All field numbers are 16 or higher while HllPb only uses numbers below 16, this way the messages
+// can be told apart when decoding.
+type HllState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Incremented for changes that older versions can't decode correctly.
+	Version   uint32  `protobuf:"varint,16,opt,name=version,proto3" json:"version,omitempty"`
+	P         uint32  `protobuf:"varint,17,opt,name=p,proto3" json:"p,omitempty"`
+	PPrime    uint32  `protobuf:"varint,18,opt,name=p_prime,json=pPrime,proto3" json:"p_prime,omitempty"`
+	ValueType *int32  `protobuf:"varint,19,opt,name=value_type,json=valueType,proto3,oneof" json:"value_type,omitempty"`
+	NumValues *uint64 `protobuf:"varint,20,opt,name=num_values,json=numValues,proto3,oneof" json:"num_values,omitempty"`
+	// Types that are assignable to Representation:
+	//	*HllState_Sparse
+	//	*HllState_Dense
+	Representation isHllState_Representation `protobuf_oneof:"representation"`
+	// The Codec used to compress the sparse list or registers, the value of its Go constant. 1 means
+	// they aren't compressed, 0 (CodecDefault) is invalid.
+	Codec uint32 `protobuf:"varint,23,opt,name=codec,proto3" json:"codec,omitempty"`
+	// The name of the Hasher of the values, empty if it isn't known.
+	Hasher string `protobuf:"bytes,24,opt,name=hasher,proto3" json:"hasher,omitempty"`
+}
+
+func (x *HllState) Reset() {
+	*x = HllState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_hll_state_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HllState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HllState) ProtoMessage() {}
+
+func (x *HllState) ProtoReflect() protoreflect.Message {
+	mi := &file_hll_state_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HllState.ProtoReflect.Descriptor instead.
+func (*HllState) Descriptor() ([]byte, []int) {
+	return file_hll_state_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *HllState) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *HllState) GetP() uint32 {
+	if x != nil {
+		return x.P
+	}
+	return 0
+}
+
+func (x *HllState) GetPPrime() uint32 {
+	if x != nil {
+		return x.PPrime
+	}
+	return 0
+}
+
+func (x *HllState) GetValueType() int32 {
+	if x != nil && x.ValueType != nil {
+		return *x.ValueType
+	}
+	return 0
+}
+
+func (x *HllState) GetNumValues() uint64 {
+	if x != nil && x.NumValues != nil {
+		return *x.NumValues
+	}
+	return 0
+}
+
+func (m *HllState) GetRepresentation() isHllState_Representation {
+	if m != nil {
+		return m.Representation
+	}
+	return nil
+}
+
+func (x *HllState) GetSparse() *HllState_SparseList {
+	if x, ok := x.GetRepresentation().(*HllState_Sparse); ok {
+		return x.Sparse
+	}
+	return nil
+}
+
+func (x *HllState) GetDense() []byte {
+	if x, ok := x.GetRepresentation().(*HllState_Dense); ok {
+		return x.Dense
+	}
+	return nil
+}
+
+func (x *HllState) GetCodec() uint32 {
+	if x != nil {
+		return x.Codec
+	}
+	return 0
+}
+
+func (x *HllState) GetHasher() string {
+	if x != nil {
+		return x.Hasher
+	}
+	return ""
+}
+
+type isHllState_Representation interface {
+	isHllState_Representation()
+}
+
+type HllState_Sparse struct {
+	Sparse *HllState_SparseList `protobuf:"bytes,21,opt,name=sparse,proto3,oneof"`
+}
+
+type HllState_Dense struct {
+	// The 6 bit registers packed together, compressed with codec.
+	Dense []byte `protobuf:"bytes,22,opt,name=dense,proto3,oneof"`
+}
+
+func (*HllState_Sparse) isHllState_Representation() {}
+
+func (*HllState_Dense) isHllState_Representation() {}
+
+type HllState_SparseList struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The uvarint encoded differences between the sparse elements, compressed with codec.
+	Buf         []byte `protobuf:"bytes,1,opt,name=buf,proto3" json:"buf,omitempty"`
+	NumElements uint64 `protobuf:"varint,2,opt,name=num_elements,json=numElements,proto3" json:"num_elements,omitempty"`
+}
+
+func (x *HllState_SparseList) Reset() {
+	*x = HllState_SparseList{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_hll_state_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HllState_SparseList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HllState_SparseList) ProtoMessage() {}
+
+func (x *HllState_SparseList) ProtoReflect() protoreflect.Message {
+	mi := &file_hll_state_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HllState_SparseList.ProtoReflect.Descriptor instead.
+func (*HllState_SparseList) Descriptor() ([]byte, []int) {
+	return file_hll_state_proto_rawDescGZIP(), []int{0, 0}
+}
+
+func (x *HllState_SparseList) GetBuf() []byte {
+	if x != nil {
+		return x.Buf
+	}
+	return nil
+}
+
+func (x *HllState_SparseList) GetNumElements() uint64 {
+	if x != nil {
+		return x.NumElements
+	}
+	return 0
+}
+
+var File_hll_state_proto protoreflect.FileDescriptor
+
+var file_hll_state_proto_rawDesc = []byte{
+	0x0a, 0x0f, 0x68, 0x6c, 0x6c, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x12, 0x03, 0x68, 0x6c, 0x6c, 0x22, 0x80, 0x03, 0x0a, 0x08, 0x48, 0x6c, 0x6c, 0x53, 0x74,
+	0x61, 0x74, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x10,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x0c, 0x0a,
+	0x01, 0x70, 0x18, 0x11, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x01, 0x70, 0x12, 0x17, 0x0a, 0x07, 0x70,
+	0x5f, 0x70, 0x72, 0x69, 0x6d, 0x65, 0x18, 0x12, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x70, 0x50,
+	0x72, 0x69, 0x6d, 0x65, 0x12, 0x22, 0x0a, 0x0a, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x5f, 0x74, 0x79,
+	0x70, 0x65, 0x18, 0x13, 0x20, 0x01, 0x28, 0x05, 0x48, 0x01, 0x52, 0x09, 0x76, 0x61, 0x6c, 0x75,
+	0x65, 0x54, 0x79, 0x70, 0x65, 0x88, 0x01, 0x01, 0x12, 0x22, 0x0a, 0x0a, 0x6e, 0x75, 0x6d, 0x5f,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x14, 0x20, 0x01, 0x28, 0x04, 0x48, 0x02, 0x52, 0x09,
+	0x6e, 0x75, 0x6d, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x88, 0x01, 0x01, 0x12, 0x32, 0x0a, 0x06,
+	0x73, 0x70, 0x61, 0x72, 0x73, 0x65, 0x18, 0x15, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x68,
+	0x6c, 0x6c, 0x2e, 0x48, 0x6c, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x65, 0x2e, 0x53, 0x70, 0x61, 0x72,
+	0x73, 0x65, 0x4c, 0x69, 0x73, 0x74, 0x48, 0x00, 0x52, 0x06, 0x73, 0x70, 0x61, 0x72, 0x73, 0x65,
+	0x12, 0x16, 0x0a, 0x05, 0x64, 0x65, 0x6e, 0x73, 0x65, 0x18, 0x16, 0x20, 0x01, 0x28, 0x0c, 0x48,
+	0x00, 0x52, 0x05, 0x64, 0x65, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x63, 0x6f, 0x64, 0x65,
+	0x63, 0x18, 0x17, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x63, 0x6f, 0x64, 0x65, 0x63, 0x12, 0x16,
+	0x0a, 0x06, 0x68, 0x61, 0x73, 0x68, 0x65, 0x72, 0x18, 0x18, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06,
+	0x68, 0x61, 0x73, 0x68, 0x65, 0x72, 0x1a, 0x41, 0x0a, 0x0a, 0x53, 0x70, 0x61, 0x72, 0x73, 0x65,
+	0x4c, 0x69, 0x73, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x62, 0x75, 0x66, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x03, 0x62, 0x75, 0x66, 0x12, 0x21, 0x0a, 0x0c, 0x6e, 0x75, 0x6d, 0x5f, 0x65, 0x6c,
+	0x65, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0b, 0x6e, 0x75,
+	0x6d, 0x45, 0x6c, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x42, 0x10, 0x0a, 0x0e, 0x72, 0x65, 0x70,
+	0x72, 0x65, 0x73, 0x65, 0x6e, 0x74, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x42, 0x0d, 0x0a, 0x0b, 0x5f,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x42, 0x0d, 0x0a, 0x0b, 0x5f, 0x6e,
+	0x75, 0x6d, 0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x42, 0x23, 0x5a, 0x21, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x65, 0x72, 0x69, 0x6b, 0x64, 0x75, 0x62, 0x62,
+	0x65, 0x6c, 0x62, 0x6f, 0x65, 0x72, 0x2f, 0x68, 0x6c, 0x6c, 0x3b, 0x68, 0x6c, 0x6c, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_hll_state_proto_rawDescOnce sync.Once
+	file_hll_state_proto_rawDescData = file_hll_state_proto_rawDesc
+)
+
+func file_hll_state_proto_rawDescGZIP() []byte {
+	file_hll_state_proto_rawDescOnce.Do(func() {
+		file_hll_state_proto_rawDescData = protoimpl.X.CompressGZIP(file_hll_state_proto_rawDescData)
+	})
+	return file_hll_state_proto_rawDescData
+}
+
+var file_hll_state_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_hll_state_proto_goTypes = []interface{}{
+	(*HllState)(nil),            // 0: hll.HllState
+	(*HllState_SparseList)(nil), // 1: hll.HllState.SparseList
+}
+var file_hll_state_proto_depIdxs = []int32{
+	1, // 0: hll.HllState.sparse:type_name -> hll.HllState.SparseList
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_hll_state_proto_init() }
+func file_hll_state_proto_init() {
+	if File_hll_state_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_hll_state_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HllState); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_hll_state_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HllState_SparseList); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_hll_state_proto_msgTypes[0].OneofWrappers = []interface{}{
+		(*HllState_Sparse)(nil),
+		(*HllState_Dense)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_hll_state_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_hll_state_proto_goTypes,
+		DependencyIndexes: file_hll_state_proto_depIdxs,
+		MessageInfos:      file_hll_state_proto_msgTypes,
+	}.Build()
+	File_hll_state_proto = out.File
+	file_hll_state_proto_rawDesc = nil
+	file_hll_state_proto_goTypes = nil
+	file_hll_state_proto_depIdxs = nil
+}
@@ -139,3 +139,210 @@ func TestCombine(t *testing.T) {
 		}
 	}
 }
+
+func TestNumValues(t *testing.T) {
+	h := NewHll(14, 25)
+	for i := 0; i < 10; i++ {
+		h.Add(1)
+	}
+	assert.Equal(t, h.NumValues(), uint64(10))
+
+	other := NewHll(14, 25)
+	other.Add(2)
+	assert.Equal(t, h.Combine(other), nil)
+	assert.Equal(t, h.NumValues(), uint64(11))
+
+	assert.Equal(t, h.Copy().NumValues(), uint64(11))
+}
+
+func TestCombineValueType(t *testing.T) {
+	h := NewHll(14, 25)
+	other := NewHll(14, 25)
+	other.SetValueType(ValueTypeInt64)
+
+	// An unknown value type takes the value type of the other sketch.
+	assert.Equal(t, h.Combine(other), nil)
+	assert.Equal(t, h.ValueType(), ValueTypeInt64)
+
+	other = NewHll(14, 25)
+	assert.Equal(t, h.Combine(other), nil)
+	assert.Equal(t, h.ValueType(), ValueTypeInt64)
+
+	other.SetValueType(ValueTypeBytesOrString)
+	assert.NotEqual(t, h.Combine(other), nil)
+}
+
+// registers returns the dense registers of h without modifying it.
+func registers(h *Hll) normal {
+	h = h.Copy()
+	h.mergeTmpSetIfAny()
+	if h.isSparse {
+		h.switchToNormal()
+	}
+	return h.bigM
+}
+
+// Combining sketches of different precisions should give the same result as adding all values to a
+// sketch with the lowest precision.
+func TestCombineMixedPrecision(t *testing.T) {
+	for _, count := range []int{100, 100000} { // Sparse and dense.
+		rands := randUint64s(t, 2*count)
+
+		high := NewHll(16, 25)
+		low := NewHll(14, 20)
+		expected := NewHll(14, 20)
+		for i, x := range rands {
+			if i < count {
+				high.Add(x)
+			} else {
+				low.Add(x)
+			}
+			expected.Add(x)
+		}
+
+		lowCopy := low.Copy()
+		highCopy := high.Copy()
+
+		assert.Equal(t, low.Combine(high), nil)
+		assert.Equal(t, low.p, uint(14))
+		assert.Equal(t, low.pPrime, uint(20))
+		assert.Equal(t, registers(low), registers(expected))
+		assert.Equal(t, high.p, uint(16)) // Other should not be downgraded.
+
+		assert.Equal(t, highCopy.Combine(lowCopy), nil)
+		assert.Equal(t, highCopy.p, uint(14))
+		assert.Equal(t, highCopy.pPrime, uint(20))
+		assert.Equal(t, registers(highCopy), registers(expected))
+		assert.Equal(t, highCopy.Cardinality(), low.Cardinality())
+	}
+}
+
+// Combining sketches with a mix of higher p and higher pPrime downgrades to the lowest of both.
+func TestCombineMixedPPrime(t *testing.T) {
+	rands := randUint64s(t, 1000)
+
+	a := NewHll(15, 20)
+	b := NewHll(14, 25)
+	expected := NewHll(14, 20)
+	for i, x := range rands {
+		if i%2 == 0 {
+			a.Add(x)
+		} else {
+			b.Add(x)
+		}
+		expected.Add(x)
+	}
+
+	assert.Equal(t, a.Combine(b), nil)
+	assert.Equal(t, a.p, uint(14))
+	assert.Equal(t, a.pPrime, uint(20))
+	assert.Equal(t, a.isSparse, expected.isSparse)
+	assert.Equal(t, a.Cardinality(), expected.Cardinality())
+	assert.Equal(t, a.sparseList.buf, expected.sparseList.buf)
+	assert.Equal(t, registers(a), registers(expected))
+}
+
+func TestDownsample(t *testing.T) {
+	for _, count := range []int{1000, 100000} { // Sparse and dense.
+		h := NewHll(18, 25)
+		expected := NewHll(12, 20)
+		for _, x := range randUint64s(t, count) {
+			h.Add(x)
+			expected.Add(x)
+		}
+
+		d, err := h.Downsample(12, 20)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, d.p, uint(12))
+		assert.Equal(t, d.pPrime, uint(20))
+		assert.Equal(t, d.m, uint64(1<<12))
+		assert.Equal(t, d.NumValues(), uint64(count))
+		assert.Equal(t, d.isSparse, expected.isSparse)
+		assert.Equal(t, d.Cardinality(), expected.Cardinality())
+		assert.Equal(t, registers(d), registers(expected))
+
+		// The original should be untouched.
+		assert.Equal(t, h.p, uint(18))
+		assert.Equal(t, h.pPrime, uint(25))
+
+		// The downsampled sketch should still be usable.
+		for _, x := range randUint64s(t, count) {
+			d.Add(x)
+			expected.Add(x)
+		}
+		assert.Equal(t, d.Cardinality(), expected.Cardinality())
+	}
+}
+
+func TestDownsampleInvalid(t *testing.T) {
+	h := NewHll(14, 20)
+
+	_, err := h.Downsample(15, 20)
+	assert.NotEqual(t, err, nil)
+	_, err = h.Downsample(14, 25)
+	assert.NotEqual(t, err, nil)
+	_, err = h.Downsample(12, 11)
+	assert.NotEqual(t, err, nil)
+	_, err = h.Downsample(3, 10)
+	assert.NotEqual(t, err, nil)
+
+	d, err := h.Downsample(14, 20)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, d.p, uint(14))
+}
+
+func TestUpgrade(t *testing.T) {
+	h := NewHll(12, 25)
+	expected := NewHll(16, 25)
+	for _, x := range randUint64s(t, 500) {
+		h.Add(x)
+		expected.Add(x)
+	}
+
+	u, err := h.Upgrade(16)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, u.p, uint(16))
+	assert.Equal(t, u.pPrime, uint(25))
+	assert.Equal(t, u.m, uint64(1<<16))
+	assert.Equal(t, h.p, uint(12)) // The original should be untouched.
+
+	assert.T(t, u.isSparse)
+	assert.T(t, expected.Cardinality() > 0)
+	assert.Equal(t, u.Cardinality(), expected.Cardinality())
+	assert.Equal(t, u.sparseList.GetNumElements(), expected.sparseList.GetNumElements())
+
+	// Registers are a lower bound, only a few may differ.
+	uM, expectedM := registers(u), registers(expected)
+	differ := 0
+	for i := uint64(0); i < u.m; i++ {
+		assert.T(t, uM.Get(i) <= expectedM.Get(i))
+		if uM.Get(i) != expectedM.Get(i) {
+			differ++
+		}
+	}
+	assert.T(t, differ < 10, differ)
+
+	// Keep adding until both become dense.
+	for _, x := range randUint64s(t, 100000) {
+		u.Add(x)
+		expected.Add(x)
+	}
+	assert.T(t, !u.isSparse)
+	card, expectedCard := float64(u.Cardinality()), float64(expected.Cardinality())
+	assert.T(t, math.Abs(card-expectedCard)/expectedCard < 0.001)
+}
+
+func TestUpgradeInvalid(t *testing.T) {
+	h := NewHll(12, 16)
+
+	_, err := h.Upgrade(11)
+	assert.NotEqual(t, err, nil)
+	_, err = h.Upgrade(17)
+	assert.NotEqual(t, err, nil)
+
+	for h.isSparse {
+		h.Add(randUint64(t))
+	}
+	_, err = h.Upgrade(14)
+	assert.NotEqual(t, err, nil)
+}
@@ -5,10 +5,12 @@ import (
 	crand "crypto/rand"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	mrand "math/rand"
 	"testing"
 
 	"github.com/bmizerany/assert"
+	"github.com/golang/protobuf/proto"
 )
 
 func TestMarshalRoundTrip(t *testing.T) {
@@ -132,6 +134,151 @@ func TestMarshalPbRoundtrip(t *testing.T) {
 	}
 }
 
+func TestUnmarshalPbLegacy(t *testing.T) {
+	h := NewHll(10, 20)
+	for i := 0; i < 100; i++ {
+		h.Add(randUint64(t))
+	}
+	h.mergeTmpSetIfAny()
+
+	// This is what older versions of MarshalPb returned.
+	p, pp := int32(10), int32(20)
+	legacy := &HllPb{
+		P:  &p,
+		Pp: &pp,
+		S: &HllPbSparse{
+			Buf:         h.sparseList.buf,
+			LastVal:     &h.sparseList.lastVal,
+			NumElements: &h.sparseList.numElements,
+		},
+	}
+	buf, err := proto.Marshal(legacy)
+	assert.Equal(t, nil, err)
+
+	rt := &Hll{}
+	assert.Equal(t, nil, rt.UnmarshalPb(buf))
+	assert.Equal(t, h.Cardinality(), rt.Cardinality())
+	assert.Equal(t, registers(h), registers(rt))
+
+	h.switchToNormal()
+	legacy.S, legacy.M = nil, h.bigM
+	buf, err = proto.Marshal(legacy)
+	assert.Equal(t, nil, err)
+
+	rt = &Hll{}
+	assert.Equal(t, nil, rt.UnmarshalPb(buf))
+	assert.Equal(t, registers(h), registers(rt))
+
+	// Neither sparse nor dense data.
+	legacy.M = nil
+	buf, err = proto.Marshal(legacy)
+	assert.Equal(t, nil, err)
+	assert.T(t, errors.Is((&Hll{}).UnmarshalPb(buf), ErrMalformed))
+
+	// An empty sparse message without the required fields, which used to be dereferenced.
+	buf = append(buf, 4<<3|2, 0)
+	assert.T(t, errors.Is((&Hll{}).UnmarshalPb(buf), ErrMalformed))
+}
+
+func TestUnmarshalPbErrors(t *testing.T) {
+	marshal := func(pb *HllState) []byte {
+		buf, err := proto.Marshal(pb)
+		assert.Equal(t, nil, err)
+		return buf
+	}
+	dense := &HllState_Dense{Dense: make([]byte, 13)}
+	none := uint32(CodecNone)
+
+	testCases := []struct {
+		name string
+		buf  []byte
+		err  error
+	}{
+		{"garbage", []byte{0xff}, ErrMalformed},
+		{"empty", nil, ErrMalformed},
+		{"version", marshal(&HllState{Version: 2, P: 4, PPrime: 4, Codec: none, Representation: dense}), ErrUnsupportedVersion},
+		{"codec", marshal(&HllState{Version: 1, P: 4, PPrime: 4, Representation: dense}), ErrUnsupportedType},
+		{"precision", marshal(&HllState{Version: 1, P: 19, PPrime: 20, Codec: none, Representation: dense}), ErrBadPrecision},
+		{"representation", marshal(&HllState{Version: 1, P: 4, PPrime: 4, Codec: none}), ErrMalformed},
+		{"dense size", marshal(&HllState{Version: 1, P: 5, PPrime: 5, Codec: none, Representation: dense}), ErrCorruptDense},
+		{"dense padding", marshal(&HllState{Version: 1, P: 4, PPrime: 4, Codec: none, Representation: &HllState_Dense{
+			Dense: append(make([]byte, 12), 1),
+		}}), ErrCorruptDense},
+		{"sparse", marshal(&HllState{Version: 1, P: 4, PPrime: 10, Codec: none, Representation: &HllState_Sparse{
+			Sparse: &HllState_SparseList{Buf: []byte{0}, NumElements: 1},
+		}}), ErrCorruptSparse},
+	}
+
+	for _, testCase := range testCases {
+		err := (&Hll{}).UnmarshalPb(testCase.buf)
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.err, err)
+		}
+	}
+
+	assert.Equal(t, nil, (&Hll{}).UnmarshalPb(marshal(&HllState{Version: 1, P: 4, PPrime: 4, Codec: none, Representation: dense})))
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		buf  string
+		err  error
+	}{
+		{"no data", `{"p":10,"pp":20}`, ErrMalformed},
+		{"both", `{"p":4,"pp":4,"M":"AAAAAAAAAAAAAAAAAA==","s":{"b":"","n":0}}`, ErrMalformed},
+	}
+
+	for _, testCase := range testCases {
+		err := json.Unmarshal([]byte(testCase.buf), &Hll{})
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.err, err)
+		}
+	}
+}
+
+func FuzzUnmarshalPb(f *testing.F) {
+	for _, n := range []int{10, 2000} { // Sparse and dense.
+		for _, codec := range []Codec{CodecNone, CodecSnappy, CodecZstd} {
+			h := NewHll(10, 20)
+			h.SetValueType(ValueTypeInt64)
+			h.SetCodec(codec)
+			r := mrand.New(mrand.NewSource(int64(n)))
+			for i := 0; i < n; i++ {
+				h.Add(r.Uint64())
+			}
+			buf, err := h.MarshalPb()
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf)
+		}
+	}
+	p, pp := int32(10), int32(20)
+	legacy, _ := proto.Marshal(&HllPb{P: &p, Pp: &pp, M: make([]byte, 768)})
+	f.Add(legacy)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := &Hll{}
+		if err := h.UnmarshalPb(data); err != nil {
+			return
+		}
+
+		buf, err := h.MarshalPb()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := &Hll{}
+		if err := rt.UnmarshalPb(buf); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, h.NumValues(), rt.NumValues())
+		assert.Equal(t, h.ValueType(), rt.ValueType())
+		assert.Equal(t, registers(h), registers(rt))
+		assert.Equal(t, h.Cardinality(), rt.Cardinality())
+	})
+}
+
 func TestMarshalGobRoundTrip(t *testing.T) {
 	testCases := []struct {
 		p, pPrime uint
@@ -168,6 +315,37 @@ func TestMarshalGobRoundTrip(t *testing.T) {
 	}
 }
 
+func TestMarshalMetadata(t *testing.T) {
+	h := NewHll(10, 20)
+	h.SetValueType(ValueTypeInt64)
+	for i := 0; i < 10; i++ {
+		h.Add(randUint64(t))
+	}
+
+	check := func(rt *Hll) {
+		assert.Equal(t, rt.NumValues(), uint64(10))
+		assert.Equal(t, rt.ValueType(), ValueTypeInt64)
+	}
+
+	jBuf, err := json.Marshal(h)
+	assert.Equal(t, nil, err)
+	rt := &Hll{}
+	assert.Equal(t, nil, json.Unmarshal(jBuf, rt))
+	check(rt)
+
+	pbBuf, err := h.MarshalPb()
+	assert.Equal(t, nil, err)
+	rt = &Hll{}
+	assert.Equal(t, nil, rt.UnmarshalPb(pbBuf))
+	check(rt)
+
+	var val bytes.Buffer
+	assert.Equal(t, nil, gob.NewEncoder(&val).Encode(h))
+	rt = &Hll{}
+	assert.Equal(t, nil, gob.NewDecoder(&val).Decode(rt))
+	check(rt)
+}
+
 func TestCompression(t *testing.T) {
 	const numTests = 1000
 
@@ -178,11 +356,13 @@ func TestCompression(t *testing.T) {
 		assert.Equal(t, nil, err)
 		assert.Equal(t, n, numToRead)
 
-		compressed, err := snappyB64(buf)
-		assert.Equal(t, nil, err)
-		roundTripped, err := unsnappyB64(compressed)
-		assert.Equal(t, nil, err)
+		for _, c := range []Codec{CodecNone, CodecSnappy, CodecZstd, CodecDeflate} {
+			compressed, err := compressB64(c, buf)
+			assert.Equal(t, nil, err)
+			roundTripped, err := decompressB64(c, compressed, numToRead)
+			assert.Equal(t, nil, err)
 
-		assert.Equal(t, buf, roundTripped)
+			assert.Equal(t, buf, roundTripped)
+		}
 	}
 }
@@ -0,0 +1,89 @@
+package hll
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// murmur3Sum128 is MurmurHash3_x64_128 by Austin Appleby. It returns both halves of the 128 bit
+// hash, blocks are read as little endian.
+func murmur3Sum128(b []byte, seed uint32) (h1, h2 uint64) {
+	const c1 = 0x87c37b91114253d5
+	const c2 = 0x4cf5ad432745937f
+
+	length := uint64(len(b))
+	h1, h2 = uint64(seed), uint64(seed)
+
+	for ; len(b) >= 16; b = b[16:] {
+		k1 := binary.LittleEndian.Uint64(b)
+		k2 := binary.LittleEndian.Uint64(b[8:])
+
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	for i := len(b) - 1; i >= 8; i-- {
+		k2 ^= uint64(b[i]) << (8 * uint(i-8))
+	}
+	if len(b) > 8 {
+		k2 *= c2
+		k2 = bits.RotateLeft64(k2, 33)
+		k2 *= c1
+		h2 ^= k2
+	}
+	for i := minInt(len(b), 8) - 1; i >= 0; i-- {
+		k1 ^= uint64(b[i]) << (8 * uint(i))
+	}
+	if len(b) > 0 {
+		k1 *= c1
+		k1 = bits.RotateLeft64(k1, 31)
+		k1 *= c2
+		h1 ^= k1
+	}
+
+	h1 ^= length
+	h2 ^= length
+
+	h1 += h2
+	h2 += h1
+
+	h1 = murmur3Fmix64(h1)
+	h2 = murmur3Fmix64(h2)
+
+	h1 += h2
+	h2 += h1
+
+	return h1, h2
+}
+
+func murmur3Fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+func minInt(x, y int) int {
+	if x <= y {
+		return x
+	}
+	return y
+}
@@ -1,6 +1,7 @@
 package hll
 
 import (
+	"encoding/base64"
 	"fmt"
 )
 
@@ -59,34 +60,30 @@ func (n normal) Copy() normal {
 	return cp
 }
 
-func (n *normal) MarshalJSON() ([]byte, error) {
-	compressed, err := snappyB64(*n)
-	if err != nil {
-		return nil, err
-	}
-
+// marshalJSONRegisters returns the (compressed) registers as a JSON string in URL-safe base64.
+func marshalJSONRegisters(data []byte) []byte {
 	// Wrap the base64 in quotes so it's a valid JSON string.
-	buf := make([]byte, len(compressed)+2)
+	buf := make([]byte, base64.URLEncoding.EncodedLen(len(data))+2)
 	buf[0] = '"'
-	copy(buf[1:], compressed)
+	base64.URLEncoding.Encode(buf[1:], data)
 	buf[len(buf)-1] = '"'
 
-	return buf, nil
+	return buf
 }
 
-func (n *normal) UnmarshalJSON(buf []byte) error {
+// The inverse of marshalJSONRegisters.
+func unmarshalJSONRegisters(buf []byte) ([]byte, error) {
 	if len(buf) < 2 {
-		return fmt.Errorf("A marshaled \"normal\" should be at least two bytes, including quotes")
+		return nil, fmt.Errorf("A marshaled \"normal\" should be at least two bytes, including quotes")
 	}
 	buf = buf[1 : len(buf)-1] // Remove the quotes from the JSON string
 
-	uncompressed, err := unsnappyB64(buf)
+	data := make([]byte, base64.URLEncoding.DecodedLen(len(buf)))
+	n, err := base64.URLEncoding.Decode(data, buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	*n = uncompressed
-	return nil
+	return data[:n], nil
 }
 
 // Given a register number, returns the bit position where it can be found in the byte slice.
@@ -0,0 +1,121 @@
+package hll
+
+import "fmt"
+
+// Defaults used by New.
+const (
+	DefaultP      = 14
+	DefaultPPrime = 25
+)
+
+// The supported precisions. encodeSparseHash stores sparse elements in 32 bits, which leaves room
+// for a pPrime of at most 31 plus the bit that flags an encoded rhoW.
+const (
+	MinP      = 4
+	MaxP      = 18
+	MaxPPrime = 31
+)
+
+type options struct {
+	p, pPrime           uint
+	sparseThresholdBits uint64
+	mergeSizeBits       uint64
+	dense               bool
+	hasher              Hasher
+}
+
+// Option configures an Hll created by New.
+type Option func(*options)
+
+// WithPrecision sets p, the number of bits used for the index of the dense registers. There are
+// 2^p registers and the standard error is about 1.04/sqrt(2^p). It must be between MinP and MaxP.
+// The default is DefaultP.
+func WithPrecision(p uint) Option {
+	return func(o *options) {
+		o.p = p
+	}
+}
+
+// WithSparsePrecision sets pPrime, the number of bits used for the index in the sparse
+// representation. It must be between p and MaxPPrime. The default is DefaultPPrime.
+func WithSparsePrecision(pPrime uint) Option {
+	return func(o *options) {
+		o.pPrime = pPrime
+	}
+}
+
+// WithSparseThresholdBits sets the size of the sparse list after which the Hll switches to the
+// dense representation. The default and maximum is the size of the dense registers, 2^p*6 bits.
+// Decoding an Hll always uses the default.
+func WithSparseThresholdBits(bits uint64) Option {
+	return func(o *options) {
+		o.sparseThresholdBits = bits
+	}
+}
+
+// WithMergeSizeBits sets the size of the temporary set of new sparse elements, every element takes
+// 64 bits. The temporary set is merged into the sparse list once it is larger. The default is a
+// quarter of the sparse threshold, the maximum is the size of the dense registers, 2^p*6 bits.
+func WithMergeSizeBits(bits uint64) Option {
+	return func(o *options) {
+		o.mergeSizeBits = bits
+	}
+}
+
+// WithDense makes the Hll start in the dense representation instead of the sparse one. This saves
+// converting it later when it is known that many values will be added.
+func WithDense() Option {
+	return func(o *options) {
+		o.dense = true
+	}
+}
+
+// WithHasher sets the hasher used by AddString, AddBytes, AddUint64Value and AddComposite. The
+// name of the hasher is stored in encoded sketches, custom hashers need to be registered with
+// RegisterHasher to decode them. The default is DefaultHasher.
+func WithHasher(hasher Hasher) Option {
+	return func(o *options) {
+		o.hasher = hasher
+	}
+}
+
+// New returns a new Hll configured by opts. Invalid options result in ErrBadPrecision for p and
+// pPrime, or another error for the other options.
+func New(opts ...Option) (*Hll, error) {
+	o := options{p: DefaultP, pPrime: DefaultPPrime}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.p < MinP || o.p > MaxP {
+		return nil, fmt.Errorf("%w: p must be in the range [%d,%d], got %d", ErrBadPrecision, MinP, MaxP, o.p)
+	}
+	if o.pPrime < o.p || o.pPrime > MaxPPrime {
+		return nil, fmt.Errorf("%w: pPrime must be in the range [%d,%d], got %d", ErrBadPrecision, o.p, MaxPPrime, o.pPrime)
+	}
+
+	h := newHll(o.p, o.pPrime)
+
+	if o.sparseThresholdBits > h.m*6 {
+		return nil, fmt.Errorf("sparse threshold must be at most %d bits, got %d", h.m*6, o.sparseThresholdBits)
+	}
+	if o.mergeSizeBits > h.m*6 {
+		return nil, fmt.Errorf("merge size must be at most %d bits, got %d", h.m*6, o.mergeSizeBits)
+	}
+	h.optSparseThresholdBits = o.sparseThresholdBits
+	h.optMergeSizeBits = o.mergeSizeBits
+	h.setThresholds()
+
+	if o.hasher != nil {
+		if err := checkHasherName(o.hasher.Name()); err != nil {
+			return nil, err
+		}
+		h.hasher = o.hasher
+	}
+
+	if o.dense {
+		h.switchToNormal()
+	}
+
+	return h, nil
+}
@@ -0,0 +1,140 @@
+package hll
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestNewDefaults(t *testing.T) {
+	h, err := New()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint(DefaultP), h.p)
+	assert.Equal(t, uint(DefaultPPrime), h.pPrime)
+	assert.T(t, h.isSparse)
+
+	// The same as NewHll.
+	assert.Equal(t, NewHll(DefaultP, DefaultPPrime), h)
+}
+
+func TestNewInvalidPrecision(t *testing.T) {
+	testCases := []struct {
+		p, pPrime uint
+	}{
+		{3, 25},
+		{19, 25},
+		{10, 9},
+		{10, 32},
+		{10, 0},
+	}
+
+	for _, testCase := range testCases {
+		_, err := New(WithPrecision(testCase.p), WithSparsePrecision(testCase.pPrime))
+		if !errors.Is(err, ErrBadPrecision) {
+			t.Errorf("p %d and pPrime %d: expected %v, got %v", testCase.p, testCase.pPrime, ErrBadPrecision, err)
+		}
+	}
+
+	defer func() {
+		assert.T(t, recover() != nil)
+	}()
+	NewHll(10, 9)
+}
+
+func TestNewValidPrecision(t *testing.T) {
+	for _, pPrime := range []uint{10, 16, 25, MaxPPrime} {
+		h, err := New(WithPrecision(10), WithSparsePrecision(pPrime))
+		assert.Equal(t, nil, err)
+
+		for i := 0; i < 10000; i++ {
+			h.Add(randUint64(t))
+		}
+		assert.T(t, !h.isSparse)
+
+		est := h.Cardinality()
+		assert.Tf(t, est > 9000 && est < 11000, "pPrime %d: %d", pPrime, est)
+	}
+}
+
+func TestNewThresholds(t *testing.T) {
+	_, err := New(WithPrecision(10), WithSparseThresholdBits(10*1024*6+1))
+	assert.NotEqual(t, nil, err)
+	_, err = New(WithPrecision(10), WithMergeSizeBits(1024*6+1))
+	assert.NotEqual(t, nil, err)
+
+	h, err := New(WithPrecision(10), WithSparseThresholdBits(1024))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(1024), h.sparseThresholdBits)
+	assert.Equal(t, uint64(256), h.mergeSizeBits)
+
+	for h.isSparse {
+		h.Add(randUint64(t))
+		if h.isSparse {
+			assert.T(t, h.sparseList.SizeInBits() <= 1024)
+		}
+	}
+	assert.T(t, h.NumValues() < 200)
+
+	h, err = New(WithMergeSizeBits(64 * 10))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 10; i++ {
+		h.Add(randUint64(t))
+	}
+	assert.Equal(t, 10, len(h.tempSet))
+	h.Add(randUint64(t))
+	assert.Equal(t, 0, len(h.tempSet))
+}
+
+func TestNewDense(t *testing.T) {
+	h, err := New(WithPrecision(8), WithDense())
+	assert.Equal(t, nil, err)
+	assert.T(t, !h.isSparse)
+
+	h.Add(randUint64(t))
+	assert.Equal(t, uint64(1), h.Cardinality())
+}
+
+// Combining sketches of different precisions changes the precision of one of them, the options it
+// was created with should be kept.
+func TestOptionsCombineMixedPrecision(t *testing.T) {
+	h, err := New(WithPrecision(12), WithSparseThresholdBits(2048), WithMergeSizeBits(64*5))
+	assert.Equal(t, nil, err)
+	other, _ := New(WithPrecision(10))
+	other.Add(randUint64(t))
+	assert.Equal(t, nil, h.Combine(other))
+	assert.Equal(t, uint(10), h.p)
+	assert.Equal(t, uint64(2048), h.sparseThresholdBits)
+	assert.Equal(t, uint64(64*5), h.mergeSizeBits)
+
+	// A threshold above the size of the registers at the new precision is lowered.
+	h, _ = New(WithPrecision(12), WithSparseThresholdBits(10000))
+	assert.Equal(t, nil, h.Combine(other))
+	assert.Equal(t, uint64(1024*6), h.sparseThresholdBits)
+	assert.Equal(t, uint64(1024*6/4), h.mergeSizeBits)
+
+	// Options that happen to equal the defaults are kept as well.
+	h, _ = New(WithPrecision(12), WithSparseThresholdBits(4096*6))
+	h.changePrecision(14, DefaultPPrime)
+	assert.Equal(t, uint64(4096*6), h.sparseThresholdBits)
+	h, _ = New(WithPrecision(12), WithMergeSizeBits(4096*6/4))
+	h.changePrecision(14, DefaultPPrime)
+	assert.Equal(t, uint64(4096*6/4), h.mergeSizeBits)
+
+	// Defaults are those of the new precision.
+	h, _ = New(WithPrecision(12))
+	assert.Equal(t, nil, h.Combine(other))
+	assert.Equal(t, NewHll(10, DefaultPPrime).sparseThresholdBits, h.sparseThresholdBits)
+	assert.Equal(t, NewHll(10, DefaultPPrime).mergeSizeBits, h.mergeSizeBits)
+
+	h, _ = New(WithPrecision(12), WithDense())
+	assert.Equal(t, nil, h.Combine(other))
+	assert.T(t, !h.isSparse)
+	assert.Equal(t, uint64(1), h.Cardinality())
+}
+
+func TestUnmarshalJSONBadPrecision(t *testing.T) {
+	err := json.Unmarshal([]byte(`{"p":30,"pp":30}`), &Hll{})
+	assert.T(t, errors.Is(err, ErrBadPrecision))
+}
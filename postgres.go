@@ -0,0 +1,279 @@
+package hll
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// PostgresPPrime is the pPrime of sketches created by NewHllFromPostgres.
+const PostgresPPrime = 25
+
+// The storage format is described in STORAGE.md.
+// See: https://github.com/citusdata/postgresql-hll/blob/master/STORAGE.md
+const (
+	postgresVersion = 1
+
+	postgresEmpty    = 1
+	postgresExplicit = 2
+	postgresSparse   = 3
+	postgresFull     = 4
+
+	postgresHeaderSize = 3
+
+	postgresExpThreshAuto = 63 // The cutoff value of an expthresh of -1.
+)
+
+// PostgresConfig holds the type modifiers of a postgresql-hll value, other than log2m which is the p
+// of the Hll. Postgres only combines values that have the same modifiers.
+type PostgresConfig struct {
+	// RegWidth is the number of bits per register, between 1 and 8. Registers that don't fit are
+	// stored as the maximum value.
+	RegWidth uint
+
+	// ExpThresh is the cardinality up to which Postgres stores the raw hashes. It is -1 to let
+	// Postgres decide, 0 to disable this or a power of 2.
+	ExpThresh int64
+
+	// SparseOn enables the SPARSE representation.
+	SparseOn bool
+}
+
+// DefaultPostgresConfig contains the postgresql-hll defaults.
+var DefaultPostgresConfig = PostgresConfig{
+	RegWidth:  5,
+	ExpThresh: -1,
+	SparseOn:  true,
+}
+
+// PostgresHash hashes a string the same way as hll_hash_text with the default seed of 0. The bits
+// are reversed, see PostgresHashBytes.
+func PostgresHash(s string) uint64 {
+	return PostgresHashBytes([]byte(s))
+}
+
+// PostgresHashBytes hashes bytes the same way as hll_hash_bytea with the default seed of 0.
+//
+// postgresql-hll uses the lowest log2m bits as the register index and the number of trailing zeros
+// of the other bits as rhoW. Reversing the bits makes this the same as an Hll with p equal to
+// log2m, except for the order of the registers which is accounted for when converting.
+func PostgresHashBytes(b []byte) uint64 {
+	h, _ := murmur3Sum128(b, 0)
+	return bits.Reverse64(h)
+}
+
+// PostgresHashInt64 hashes an int64 the same way as hll_hash_bigint with the default seed of 0.
+func PostgresHashInt64(v int64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	return PostgresHashBytes(b[:])
+}
+
+// PostgresHashInt32 hashes an int32 the same way as hll_hash_integer with the default seed of 0.
+func PostgresHashInt32(v int32) uint64 {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	return PostgresHashBytes(b[:])
+}
+
+// NewHllFromPostgres decodes a postgresql-hll value in schema version 1. The resulting Hll has p
+// equal to log2m and pPrime PostgresPPrime, add values to it using the PostgresHash functions.
+// EXPLICIT values contain the hashes themselves, SPARSE and FULL values only the registers.
+//
+// Values with a log2m above 18 result in ErrBadPrecision.
+func NewHllFromPostgres(data []byte) (*Hll, error) {
+	if len(data) < postgresHeaderSize {
+		return nil, fmt.Errorf("%w: value too short", ErrMalformed)
+	}
+
+	version, typ := data[0]>>4, data[0]&0xf
+	regWidth, log2m := uint(data[1]>>5)+1, uint(data[1]&0x1f)
+
+	if version != postgresVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	if log2m < 4 || log2m > 18 {
+		return nil, fmt.Errorf("%w: log2m %d", ErrBadPrecision, log2m)
+	}
+
+	h := NewHll(log2m, PostgresPPrime)
+	data = data[postgresHeaderSize:]
+
+	switch typ {
+	case postgresEmpty:
+		return h, nil
+	case postgresExplicit:
+		return h, h.setPostgresExplicit(data)
+	case postgresSparse:
+		return h, h.setPostgresSparse(data, regWidth)
+	case postgresFull:
+		return h, h.setPostgresFull(data, regWidth)
+	}
+	return nil, fmt.Errorf("%w: type %d", ErrUnsupportedType, typ)
+}
+
+func (h *Hll) setPostgresExplicit(data []byte) error {
+	if len(data)%8 != 0 {
+		return fmt.Errorf("%w: %d bytes is not a multiple of 8", ErrCorruptSparse, len(data))
+	}
+
+	for ; len(data) > 0; data = data[8:] {
+		x := binary.BigEndian.Uint64(data)
+
+		// postgresql-hll ignores hashes without any bits set after the index.
+		if x>>h.p != 0 {
+			h.addHash(bits.Reverse64(x))
+		}
+	}
+
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+func (h *Hll) setPostgresSparse(data []byte, regWidth uint) error {
+	width := h.p + regWidth
+	n := uint64(len(data)) * 8 / uint64(width)
+	maxRhoW := postgresMaxRhoW(h.p, regWidth)
+
+	for i := uint64(0); i < n; i++ {
+		entry := postgresGetBits(data, i*uint64(width), width)
+		idx, r := entry>>regWidth, uint8(entry&(1<<regWidth-1))
+
+		// The padding at the end can look like an entry with value 0.
+		if r == 0 {
+			continue
+		}
+		if r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptSparse, idx, r)
+		}
+		h.addHash(decodeNormalToHash(postgresRegister(idx, h.p), r, h.p))
+	}
+
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+func (h *Hll) setPostgresFull(data []byte, regWidth uint) error {
+	if size := (h.m*uint64(regWidth) + 7) / 8; uint64(len(data)) != size {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrCorruptDense, size, len(data))
+	}
+
+	maxRhoW := postgresMaxRhoW(h.p, regWidth)
+	h.switchToNormal()
+
+	for i := uint64(0); i < h.m; i++ {
+		r := uint8(postgresGetBits(data, i*uint64(regWidth), regWidth))
+		if r > maxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+		h.bigM.Set(postgresRegister(i, h.p), r)
+	}
+	return nil
+}
+
+// postgresMaxRhoW returns the highest register value possible with the given p and register width.
+func postgresMaxRhoW(p, regWidth uint) uint8 {
+	return uint8(minUint(1<<regWidth-1, 64-p+1))
+}
+
+// postgresRegister converts between postgresql-hll and Hll register indexes. Because the hash bits
+// are reversed, so is the register index.
+func postgresRegister(idx uint64, p uint) uint64 {
+	return bits.Reverse64(idx) >> (64 - p)
+}
+
+// MarshalPostgres encodes the Hll as a postgresql-hll value using DefaultPostgresConfig.
+func (h *Hll) MarshalPostgres() ([]byte, error) {
+	return h.MarshalPostgresConfig(DefaultPostgresConfig)
+}
+
+// MarshalPostgresConfig encodes the Hll as a postgresql-hll value with log2m equal to p and the
+// other modifiers from c. The modifiers have to match the column the value is used with.
+//
+// Only the registers are known, so the value is never EXPLICIT. It is SPARSE if that is enabled and
+// smaller than FULL.
+func (h *Hll) MarshalPostgresConfig(c PostgresConfig) ([]byte, error) {
+	if c.RegWidth < 1 || c.RegWidth > 8 {
+		return nil, fmt.Errorf("register width must be in the range [1,8]")
+	}
+
+	var cutoff byte
+	switch {
+	case c.ExpThresh == -1:
+		cutoff = postgresExpThreshAuto
+	case c.ExpThresh == 0:
+		cutoff = 0
+	case c.ExpThresh > 0 && c.ExpThresh&(c.ExpThresh-1) == 0 && bits.Len64(uint64(c.ExpThresh)) < postgresExpThreshAuto:
+		cutoff = byte(bits.Len64(uint64(c.ExpThresh)))
+	default:
+		return nil, fmt.Errorf("expthresh must be -1, 0 or a power of 2")
+	}
+	if c.SparseOn {
+		cutoff |= 1 << 6
+	}
+
+	h.mergeTmpSetIfAny()
+
+	M := h.bigM
+	if h.isSparse {
+		M = toNormal(h.sparseList, h.p, h.pPrime)
+	}
+
+	maxRhoW := postgresMaxRhoW(h.p, c.RegWidth)
+	registers := make([]uint8, h.m)
+	nonZero := uint64(0)
+	for i := uint64(0); i < h.m; i++ {
+		if r := M.Get(i); r > 0 {
+			registers[postgresRegister(i, h.p)] = minU8(r, maxRhoW)
+			nonZero++
+		}
+	}
+
+	data := []byte{postgresVersion<<4 | postgresEmpty, byte(c.RegWidth-1)<<5 | byte(h.p), cutoff}
+	if nonZero == 0 {
+		return data, nil
+	}
+
+	width := h.p + c.RegWidth
+	sparseBits := nonZero * uint64(width)
+	fullBits := h.m * uint64(c.RegWidth)
+
+	if c.SparseOn && sparseBits < fullBits {
+		data[0] = postgresVersion<<4 | postgresSparse
+		data = append(data, make([]byte, (sparseBits+7)/8)...)
+
+		off := uint64(postgresHeaderSize * 8)
+		for i, r := range registers {
+			if r > 0 {
+				postgresPutBits(data, off, width, uint64(i)<<c.RegWidth|uint64(r))
+				off += uint64(width)
+			}
+		}
+		return data, nil
+	}
+
+	data[0] = postgresVersion<<4 | postgresFull
+	data = append(data, make([]byte, (fullBits+7)/8)...)
+	for i, r := range registers {
+		postgresPutBits(data, uint64(postgresHeaderSize*8+i*int(c.RegWidth)), c.RegWidth, uint64(r))
+	}
+	return data, nil
+}
+
+// postgresGetBits reads n bits at bit offset off, postgresql-hll packs values starting at the most
+// significant bit.
+func postgresGetBits(data []byte, off uint64, n uint) uint64 {
+	var v uint64
+	for i := uint64(0); i < uint64(n); i++ {
+		v = v<<1 | uint64(data[(off+i)/8]>>(7-(off+i)%8)&1)
+	}
+	return v
+}
+
+func postgresPutBits(data []byte, off uint64, n uint, v uint64) {
+	for i := uint64(0); i < uint64(n); i++ {
+		if v>>(uint64(n)-1-i)&1 != 0 {
+			data[(off+i)/8] |= 0x80 >> ((off + i) % 8)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestPostgres_Hash(t *testing.T) {
+	// Generated with the MurmurHash3_x64_128 reference implementation, these are the values
+	// hll_hash_text returns.
+	tests := []struct {
+		s string
+		h int64
+	}{
+		{"", 0},
+		{"hello", -3758069500696749310},
+		{"hello world", 5998619086395760910},
+		{"0123456789abcdef", 5467490433528156583},
+		{"0123456789abcdefg", -8200385122730116642},
+		{"The quick brown fox jumps over the lazy dog", -2068352364225029268},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			if h := PostgresHash(test.s); int64(bits.Reverse64(h)) != test.h {
+				t.Errorf("expected %d got %d", test.h, int64(bits.Reverse64(h)))
+			}
+		})
+	}
+}
+
+func TestPostgres_HashInt(t *testing.T) {
+	tests64 := []struct {
+		v int64
+		h int64
+	}{
+		{0, 2945182322382062539},
+		{1, 19144387141682250},
+		{-1, -6853156495446839949},
+		{42, -5283633198602748424},
+		{1234567890123, -2940519162795661581},
+	}
+	for _, test := range tests64 {
+		if h := PostgresHashInt64(test.v); int64(bits.Reverse64(h)) != test.h {
+			t.Errorf("%d: expected %d got %d", test.v, test.h, int64(bits.Reverse64(h)))
+		}
+	}
+
+	tests32 := []struct {
+		v int32
+		h int64
+	}{
+		{0, -3485513579396041028},
+		{1, -8604791237420463362},
+		{-1, 4889297221962843713},
+		{42, 2913627637088662735},
+	}
+	for _, test := range tests32 {
+		if h := PostgresHashInt32(test.v); int64(bits.Reverse64(h)) != test.h {
+			t.Errorf("%d: expected %d got %d", test.v, test.h, int64(bits.Reverse64(h)))
+		}
+	}
+}
+
+func TestPostgres_Sparse(t *testing.T) {
+	// log2m 11, regwidth 5 and a single register 1 with value 3.
+	data := []byte{0x13, 0x8b, 0x7f, 0x00, 0x23}
+
+	h, err := NewHllFromPostgres(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.p != 11 {
+		t.Errorf("expected p 11 got %d", h.p)
+	}
+	if r := registers(h).Get(1 << 10); r != 3 {
+		t.Errorf("expected register %d to be 3 got %d", 1<<10, r)
+	}
+
+	out, err := h.MarshalPostgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("expected %x got %x", data, out)
+	}
+}
+
+func TestPostgres_Explicit(t *testing.T) {
+	h := NewHll(11, PostgresPPrime)
+
+	var hashes []int64
+	for i := int64(0); i < 100; i++ {
+		x := PostgresHashInt64(i)
+		h.Add(x)
+		hashes = append(hashes, int64(bits.Reverse64(x)))
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	data := []byte{0x12, 0x8b, 0x7f}
+	for _, x := range hashes {
+		data = append(data, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(data[len(data)-8:], uint64(x))
+	}
+
+	h2, err := NewHllFromPostgres(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Cardinality() != h2.Cardinality() {
+		t.Errorf("expected cardinality %d got %d", h.Cardinality(), h2.Cardinality())
+	}
+}
+
+func TestPostgres_RoundTrip(t *testing.T) {
+	for _, p := range []uint{4, 11, 14} {
+		for _, n := range []int{0, 10, 1000, 100000} {
+			for _, regWidth := range []uint{4, 5, 6} {
+				t.Run(fmt.Sprintf("p%d-%d-%d", p, n, regWidth), func(t *testing.T) {
+					h := NewHll(p, PostgresPPrime)
+					for i := 0; i < n; i++ {
+						h.Add(rand.Uint64())
+					}
+
+					c := DefaultPostgresConfig
+					c.RegWidth = regWidth
+					data, err := h.MarshalPostgresConfig(c)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					h2, err := NewHllFromPostgres(data)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					M, M2 := registers(h), registers(h2)
+					for i := uint64(0); i < h.m; i++ {
+						if expected := minU8(M.Get(i), 1<<regWidth-1); M2.Get(i) != expected {
+							t.Fatalf("register %d: expected %d got %d", i, expected, M2.Get(i))
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestPostgres_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short", []byte{0x11, 0x8b}, ErrMalformed},
+		{"version", []byte{0x21, 0x8b, 0x7f}, ErrUnsupportedVersion},
+		{"log2m", []byte{0x11, 0x9f, 0x7f}, ErrBadPrecision},
+		{"undefined", []byte{0x10, 0x8b, 0x7f}, ErrUnsupportedType},
+		{"explicit", []byte{0x12, 0x8b, 0x7f, 1, 2, 3}, ErrCorruptSparse},
+		{"sparse", []byte{0x13, 0xe4, 0x7f, 0xff, 0xff}, ErrCorruptSparse},
+		{"full", []byte{0x14, 0x8b, 0x7f, 0x00}, ErrCorruptDense},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewHllFromPostgres(test.data); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, err := NewHll(11, 25).MarshalPostgresConfig(PostgresConfig{RegWidth: 5, ExpThresh: 3}); err == nil {
+		t.Errorf("expected an error for expthresh 3")
+	}
+}
@@ -0,0 +1,269 @@
+package hll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// RedisP is the precision of Redis HyperLogLogs. Sketches created by NewHllFromRedis also use it as
+// pPrime, Redis doesn't store anything more precise.
+const RedisP = 14
+
+// The HYLL format is described in hyperloglog.c.
+// See: https://github.com/redis/redis/blob/7.2/src/hyperloglog.c
+const (
+	redisHeaderSize = 16
+	redisRegisters  = 1 << RedisP
+	redisDenseSize  = redisHeaderSize + (redisRegisters*6+7)/8
+	redisMaxRhoW    = 64 - RedisP + 1
+
+	redisDense  = 0
+	redisSparse = 1
+
+	redisSparseMaxValue = 32
+	redisSparseMaxBytes = 3000 // The default hll-sparse-max-bytes.
+
+	redisSeed = 0xadc83b19
+)
+
+var redisMagic = []byte("HYLL")
+
+// RedisHash hashes a string the same way PFADD does. The result is rearranged so that adding it to
+// an Hll with p 14 updates the same register as in Redis.
+func RedisHash(s string) uint64 {
+	return RedisHashBytes([]byte(s))
+}
+
+// RedisHashBytes is the same as RedisHash but for a byte slice.
+func RedisHashBytes(b []byte) uint64 {
+	x := murmurHash64A(b, redisSeed)
+
+	// Redis uses the lowest 14 bits as the register index and the number of trailing zeros of the
+	// remaining 50 bits as rhoW. We use the highest bits for the index and count leading zeros.
+	return x&(redisRegisters-1)<<(64-RedisP) | bits.Reverse64(x>>RedisP)>>RedisP
+}
+
+// murmurHash64A is MurmurHash64A by Austin Appleby, reading blocks as little endian like Redis does.
+func murmurHash64A(b []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(b))*m
+
+	for ; len(b) >= 8; b = b[8:] {
+		k := binary.LittleEndian.Uint64(b)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+	}
+
+	if len(b) > 0 {
+		for i := len(b) - 1; i >= 0; i-- {
+			h ^= uint64(b[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
+
+// NewHllFromRedis decodes the value of a Redis HyperLogLog key as returned by GET. Both the sparse
+// and dense encoding are supported. The resulting Hll has p and pPrime RedisP, add values to it
+// using RedisHash.
+//
+// Combining it with an Hll with a higher pPrime lowers the pPrime of the result to RedisP.
+func NewHllFromRedis(data []byte) (*Hll, error) {
+	if len(data) < redisHeaderSize || !bytes.Equal(data[:4], redisMagic) {
+		return nil, fmt.Errorf("%w: missing HYLL header", ErrMalformed)
+	}
+
+	h := NewHll(RedisP, RedisP)
+
+	switch data[4] {
+	case redisDense:
+		return h, h.setRedisDense(data[redisHeaderSize:])
+	case redisSparse:
+		return h, h.setRedisSparse(data[redisHeaderSize:])
+	}
+	return nil, fmt.Errorf("%w: encoding %d", ErrUnsupportedType, data[4])
+}
+
+func (h *Hll) setRedisDense(data []byte) error {
+	if len(data) != redisDenseSize-redisHeaderSize {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrCorruptDense, redisDenseSize-redisHeaderSize, len(data))
+	}
+
+	h.switchToNormal()
+
+	for i := uint64(0); i < redisRegisters; i++ {
+		r := redisRegister(data, i)
+		if r > redisMaxRhoW {
+			return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+		}
+		h.bigM.Set(i, r)
+	}
+	return nil
+}
+
+// redisRegister returns a register from the dense encoding. Redis stores registers starting at the
+// least significant bit while normal starts at the most significant bit.
+func redisRegister(data []byte, i uint64) uint8 {
+	b, fb := i*6/8, i*6%8
+
+	v := uint(data[b]) >> fb
+	if b+1 < uint64(len(data)) {
+		v |= uint(data[b+1]) << (8 - fb)
+	}
+	return uint8(v & 0x3f)
+}
+
+func setRedisRegister(data []byte, i uint64, r uint8) {
+	b, fb := i*6/8, i*6%8
+
+	data[b] |= r << fb
+	if b+1 < uint64(len(data)) {
+		data[b+1] |= r >> (8 - fb)
+	}
+}
+
+// setRedisSparse decodes the sparse opcodes:
+//
+//	00xxxxxx          ZERO:  xxxxxx+1 registers are 0.
+//	01xxxxxx yyyyyyyy XZERO: xxxxxxyyyyyyyy+1 registers are 0.
+//	1vvvvvxx          VAL:   xx+1 registers are vvvvv+1.
+func (h *Hll) setRedisSparse(data []byte) error {
+	idx := uint64(0)
+	for i := 0; i < len(data); i++ {
+		op := data[i]
+
+		switch {
+		case op&0xc0 == 0x00:
+			idx += uint64(op&0x3f) + 1
+		case op&0xc0 == 0x40:
+			if i+1 == len(data) {
+				return fmt.Errorf("%w: truncated XZERO", ErrCorruptSparse)
+			}
+			i++
+			idx += uint64(op&0x3f)<<8 | uint64(data[i]) + 1
+		default:
+			r := (op>>2)&0x1f + 1
+			run := uint64(op&0x3) + 1
+			if idx+run > redisRegisters {
+				return fmt.Errorf("%w: opcodes cover more than %d registers", ErrCorruptSparse, redisRegisters)
+			}
+			for j := uint64(0); j < run; j++ {
+				h.addHash(decodeNormalToHash(idx+j, r, RedisP))
+			}
+			idx += run
+		}
+
+		if idx > redisRegisters {
+			return fmt.Errorf("%w: opcodes cover more than %d registers", ErrCorruptSparse, redisRegisters)
+		}
+	}
+
+	if idx != redisRegisters {
+		return fmt.Errorf("%w: opcodes cover %d registers instead of %d", ErrCorruptSparse, idx, redisRegisters)
+	}
+
+	h.mergeTmpSetIfAny()
+	return nil
+}
+
+// MarshalRedis encodes the Hll in the Redis HYLL format so it can be stored with SET and used with
+// PFCOUNT and PFMERGE. Like Redis, the sparse encoding is used as long as it fits in the default
+// hll-sparse-max-bytes and no register is above 32.
+//
+// An Hll with a p above RedisP is downsampled first. A lower p can't be converted and results in an
+// error. The cached cardinality is marked as invalid so Redis computes it with its own estimator.
+func (h *Hll) MarshalRedis() ([]byte, error) {
+	if h.p < RedisP {
+		return nil, fmt.Errorf("precision %d is lower than the Redis precision %d", h.p, RedisP)
+	}
+
+	d := h
+	if h.p > RedisP {
+		var err error
+		if d, err = h.Downsample(RedisP, RedisP); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mergeTmpSetIfAny()
+
+	registers := d.bigM
+	if d.isSparse {
+		registers = toNormal(d.sparseList, d.p, d.pPrime)
+	}
+
+	header := make([]byte, redisHeaderSize, redisDenseSize)
+	copy(header, redisMagic)
+	header[15] = 0x80 // The most significant bit of the cached cardinality marks it as invalid.
+
+	if sparse, ok := redisSparseOpcodes(registers); ok {
+		header[4] = redisSparse
+		return append(header, sparse...), nil
+	}
+
+	header[4] = redisDense
+	data := header[:redisDenseSize]
+	for i := uint64(0); i < redisRegisters; i++ {
+		setRedisRegister(data[redisHeaderSize:], i, registers.Get(i))
+	}
+	return data, nil
+}
+
+// redisSparseOpcodes returns the sparse encoding of the registers. It returns false if the registers
+// can't be sparse encoded or the result would be larger than redisSparseMaxBytes.
+func redisSparseOpcodes(registers normal) ([]byte, bool) {
+	var data []byte
+
+	for i := uint64(0); i < redisRegisters; {
+		r := registers.Get(i)
+
+		run := uint64(1)
+		for i+run < redisRegisters && registers.Get(i+run) == r {
+			run++
+		}
+		i += run
+
+		switch {
+		case r == 0:
+			for ; run > 64; run -= min64(run, 1<<14) {
+				n := min64(run, 1<<14) - 1
+				data = append(data, 0x40|byte(n>>8), byte(n))
+			}
+			if run > 0 {
+				data = append(data, byte(run-1))
+			}
+		case r > redisSparseMaxValue:
+			return nil, false
+		default:
+			for ; run > 0; run -= min64(run, 4) {
+				data = append(data, 0x80|(r-1)<<2|byte(min64(run, 4)-1))
+			}
+		}
+
+		if len(data) > redisSparseMaxBytes {
+			return nil, false
+		}
+	}
+
+	return data, true
+}
+
+func min64(x, y uint64) uint64 {
+	if x <= y {
+		return x
+	}
+	return y
+}
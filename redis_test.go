@@ -0,0 +1,147 @@
+package hll
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestRedis_Hash(t *testing.T) {
+	// Generated with MurmurHash64A and hllPatLen from the Redis source.
+	tests := []struct {
+		s     string
+		h     uint64
+		index uint64
+		count uint8
+	}{
+		{"", 15627466953755236146, 5938, 2},
+		{"a", 6039968161137406375, 12711, 2},
+		{"foo", 16592960565925911732, 7348, 5},
+		{"hello", 1109414937308947456, 9216, 1},
+		{"hello world", 12184977182547125431, 9399, 4},
+		{"12345678", 10802930868819274067, 10579, 3},
+		{"abcdefghijklmnopqrstuvwxyz", 17039401960413459151, 13007, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			if h := murmurHash64A([]byte(test.s), redisSeed); h != test.h {
+				t.Errorf("expected murmur hash %d got %d", test.h, h)
+			}
+
+			h := NewHll(RedisP, 25)
+			h.Add(RedisHash(test.s))
+
+			M := registers(h)
+			if r := M.Get(test.index); r != test.count {
+				t.Errorf("expected register %d to be %d got %d", test.index, test.count, r)
+			}
+		})
+	}
+}
+
+func TestRedis_Sparse(t *testing.T) {
+	// PFADD of "a" and "foo": XZERO 7348, VAL 5, XZERO 5362, VAL 2, XZERO 3672.
+	data := append([]byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80"),
+		0x40|7347>>8, 7347&0xff, 0x80|4<<2,
+		0x40|5361>>8, 5361&0xff, 0x80|1<<2,
+		0x40|3671>>8, 3671&0xff,
+	)
+
+	h, err := NewHllFromRedis(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := h.Cardinality(); c != 2 {
+		t.Errorf("expected cardinality 2 got %d", c)
+	}
+
+	h2 := NewHll(RedisP, RedisP)
+	h2.Add(RedisHash("a"))
+	h2.Add(RedisHash("foo"))
+
+	M, M2 := registers(h), registers(h2)
+	for i := uint64(0); i < redisRegisters; i++ {
+		if M.Get(i) != M2.Get(i) {
+			t.Fatalf("register %d: expected %d got %d", i, M2.Get(i), M.Get(i))
+		}
+	}
+
+	out, err := h2.MarshalRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(data) {
+		t.Errorf("expected %x got %x", data, out)
+	}
+}
+
+func TestRedis_RoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 2000, 100000} {
+		for _, p := range []uint{14, 16} {
+			t.Run(strconv.Itoa(n)+"-"+strconv.Itoa(int(p)), func(t *testing.T) {
+				h := NewHll(p, 25)
+				for i := 0; i < n; i++ {
+					h.Add(rand.Uint64())
+				}
+
+				data, err := h.MarshalRedis()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				h2, err := NewHllFromRedis(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expected, err := h.Downsample(RedisP, RedisP)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				M, M2 := registers(expected), registers(h2)
+				for i := uint64(0); i < redisRegisters; i++ {
+					if M.Get(i) != M2.Get(i) {
+						t.Fatalf("register %d: expected %d got %d", i, M.Get(i), M2.Get(i))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRedis_Errors(t *testing.T) {
+	header := func(encoding byte) []byte {
+		return []byte{'H', 'Y', 'L', 'L', encoding, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short", []byte("HYLL"), ErrMalformed},
+		{"magic", []byte("HYLX\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ErrMalformed},
+		{"encoding", header(2), ErrUnsupportedType},
+		{"dense size", append(header(0), make([]byte, 100)...), ErrCorruptDense},
+		{"dense value", append(header(0), append(make([]byte, 12287), 0xff)...), ErrCorruptDense},
+		{"sparse short", append(header(1), 0x3f), ErrCorruptSparse},
+		{"sparse truncated", append(header(1), 0x7f), ErrCorruptSparse},
+		{"sparse long", append(header(1), 0x7f, 0xff, 0x80), ErrCorruptSparse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewHllFromRedis(test.data); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, err := NewHll(12, 25).MarshalRedis(); err == nil {
+		t.Errorf("expected an error for p 12")
+	}
+}
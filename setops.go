@@ -0,0 +1,384 @@
+package hll
+
+import (
+	"math"
+)
+
+// IntersectionCardinality estimates the number of distinct values in both a and b with the
+// inclusion–exclusion principle, |A| + |B| - |A ∪ B|. The inputs aren't modified, the estimates
+// are made at the lowest precision of the two like Union.
+//
+// The error of the result is about the error of the union estimate, which is proportional to the
+// size of the union and not to the size of the intersection. With p 14 the standard error of a
+// cardinality is about 0.8%, so the intersection of two sets of a million values can be off by
+// more than 10000 even if the sets are disjoint. Small intersections of large sets can't be
+// estimated this way, JointEstimate has a lower error.
+func IntersectionCardinality(a, b *Hll) (uint64, error) {
+	ca, cb, cu, err := pairCardinalities(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return intersectionFrom(ca, cb, cu), nil
+}
+
+// intersectionFrom returns the inclusion–exclusion estimate of the intersection from the
+// cardinalities of a, b and their union.
+func intersectionFrom(ca, cb, cu uint64) uint64 {
+	return clampEstimate(float64(ca)+float64(cb)-float64(cu), minU64(ca, cb))
+}
+
+// DifferenceCardinality estimates the number of distinct values in a that aren't in b as
+// |A ∪ B| - |B|. It has the same error behaviour as IntersectionCardinality.
+func DifferenceCardinality(a, b *Hll) (uint64, error) {
+	ca, cb, cu, err := pairCardinalities(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return clampEstimate(float64(cu)-float64(cb), ca), nil
+}
+
+// Jaccard estimates the Jaccard index |A ∩ B| / |A ∪ B| with IntersectionCardinality. It is 0 if
+// both sets are empty.
+func Jaccard(a, b *Hll) (float64, error) {
+	ca, cb, cu, err := pairCardinalities(a, b)
+	if err != nil || cu == 0 {
+		return 0, err
+	}
+	return float64(intersectionFrom(ca, cb, cu)) / float64(cu), nil
+}
+
+// pairCardinalities returns the cardinalities of a, b and their union at the precision of the
+// union.
+func pairCardinalities(a, b *Hll) (ca, cb, cu uint64, err error) {
+	u, err := newUnion([]*Hll{a, b})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return u.single(a).cardinality(), u.single(b).cardinality(), u.cardinality(), nil
+}
+
+// clampEstimate rounds x to the range [0,max].
+func clampEstimate(x float64, max uint64) uint64 {
+	if x <= 0 {
+		return 0
+	}
+	return minU64(roundFloatToUint64(x), max)
+}
+
+func minU64(x, y uint64) uint64 {
+	if x <= y {
+		return x
+	}
+	return y
+}
+
+// JointCardinality is the estimated number of distinct values that are only in A, only in B and
+// in both.
+type JointCardinality struct {
+	OnlyA, OnlyB, Both uint64
+}
+
+// Union returns the estimated number of distinct values in A or B.
+func (j JointCardinality) Union() uint64 {
+	return j.OnlyA + j.OnlyB + j.Both
+}
+
+// Jaccard returns the estimated Jaccard index, or 0 if both sets are empty.
+func (j JointCardinality) Jaccard() float64 {
+	if j.Union() == 0 {
+		return 0
+	}
+	return float64(j.Both) / float64(j.Union())
+}
+
+// JointEstimate estimates the number of distinct values that are only in a, only in b and in
+// both with the maximum likelihood method from "New cardinality estimation algorithms for
+// HyperLogLog sketches" by Otmar Ertl, section 5. Instead of combining three independent estimates
+// like IntersectionCardinality it compares the registers of a and b one by one, for example a
+// register that is higher in a than in b can only have been set by a value that isn't in b.
+//
+// The error still grows with the size of the union but it is smaller than that of
+// inclusion–exclusion, especially for small intersections. When both inputs are sparse the indexes
+// of the sparse elements are compared at pPrime bits, which makes the estimates of sets with fewer
+// than about 2^p values almost exact.
+//
+// The inputs aren't modified. They are compared at the lowest precision of the two like Union and
+// must have the same value type and hasher, if known.
+func JointEstimate(a, b *Hll) (JointCardinality, error) {
+	u, err := newUnion([]*Hll{a, b})
+	if err != nil {
+		return JointCardinality{}, err
+	}
+	ua, ub := u.single(a), u.single(b)
+
+	var c *jointCounts
+	if len(u.dense) == 0 {
+		c = sparseJointCounts(ua, ub)
+	} else {
+		c = denseJointCounts(ua, ub)
+	}
+
+	// Start at the inclusion–exclusion estimates.
+	ca, cb, cu := ua.cardinality(), ub.cardinality(), u.cardinality()
+	both := intersectionFrom(ca, cb, cu)
+	start := [3]float64{float64(ca - both), float64(cb - both), float64(both)}
+
+	x := c.maximize(start)
+	return JointCardinality{
+		OnlyA: roundFloatToUint64(x[0]),
+		OnlyB: roundFloatToUint64(x[1]),
+		Both:  roundFloatToUint64(x[2]),
+	}, nil
+}
+
+// jointCounts counts the pairs of register values of two sketches by register value k. For a pair
+// (k1, k2) with k1 < k2 less1[k1] and greater2[k2] are incremented, for k1 > k2 greater1[k1] and
+// less2[k2], and for k1 == k2 equal[k1].
+type jointCounts struct {
+	m float64
+	q int // the registers values are in [0,q+1]
+
+	less1, greater1, less2, greater2, equal []float64
+}
+
+func newJointCounts(m uint64, q int) *jointCounts {
+	return &jointCounts{
+		m:        float64(m),
+		q:        q,
+		less1:    make([]float64, q+2),
+		greater1: make([]float64, q+2),
+		less2:    make([]float64, q+2),
+		greater2: make([]float64, q+2),
+		equal:    make([]float64, q+2),
+	}
+}
+
+func (c *jointCounts) add(k1, k2 uint8) {
+	switch {
+	case k1 < k2:
+		c.less1[k1]++
+		c.greater2[k2]++
+	case k1 > k2:
+		c.greater1[k1]++
+		c.less2[k2]++
+	default:
+		c.equal[k1]++
+	}
+}
+
+// denseJointCounts compares the dense registers of a and b, each a single sketch.
+func denseJointCounts(a, b *union) *jointCounts {
+	c := newJointCounts(1<<a.p, 64-int(a.p))
+
+	registers := newNormal(1 << a.p)
+	a.registers(nil, func(i uint64, r uint8) {
+		if r > 0 {
+			registers.Set(i, r)
+		}
+	})
+	b.registers(nil, func(i uint64, r uint8) {
+		c.add(registers.Get(i), r)
+	})
+	return c
+}
+
+// sparseJointCounts compares the indexes of the sparse elements of a and b, each a single sparse
+// sketch. This is the same as comparing registers at pPrime bits that are 1 if an element has the
+// index and 0 otherwise.
+func sparseJointCounts(a, b *union) *jointCounts {
+	c := newJointCounts(1<<a.pPrime, 0)
+
+	var indexes []uint64
+	a.merge(func(k uint64) {
+		idx, _ := decodeSparseHash(k, a.p, a.pPrime)
+		indexes = append(indexes, idx)
+	})
+
+	var onlyA, onlyB, both float64
+	b.merge(func(k uint64) {
+		idx, _ := decodeSparseHash(k, b.p, b.pPrime)
+		for len(indexes) > 0 && indexes[0] < idx {
+			indexes = indexes[1:]
+			onlyA++
+		}
+		if len(indexes) > 0 && indexes[0] == idx {
+			indexes = indexes[1:]
+			both++
+		} else {
+			onlyB++
+		}
+	})
+	onlyA += float64(len(indexes))
+
+	c.greater1[1], c.less2[0] = onlyA, onlyA
+	c.less1[0], c.greater2[1] = onlyB, onlyB
+	c.equal[1] = both
+	c.equal[0] = c.m - onlyA - onlyB - both
+	return c
+}
+
+// cdf returns the probability that a register is at most k after adding lambda distinct values,
+// using the Poisson approximation from the paper.
+func (c *jointCounts) cdf(lambda float64, k int) float64 {
+	if k < 0 {
+		return 0
+	}
+	if k > c.q {
+		return 1
+	}
+	return math.Exp(-lambda / (c.m * math.Exp2(float64(k))))
+}
+
+// pmf returns the probability that a register is k after adding lambda distinct values.
+func (c *jointCounts) pmf(lambda float64, k int) float64 {
+	if k == 0 {
+		return math.Exp(-lambda / c.m)
+	}
+	if k > c.q {
+		return -math.Expm1(-lambda / (c.m * math.Exp2(float64(c.q))))
+	}
+	// cdf(k-1) is cdf(k) squared.
+	x := -lambda / (c.m * math.Exp2(float64(k)))
+	return math.Exp(x) * -math.Expm1(x)
+}
+
+// logLikelihood returns the log-likelihood of the counts for a values only in A, b values only in
+// B and x values in both.
+func (c *jointCounts) logLikelihood(a, b, x float64) float64 {
+	ll := float64(0)
+	term := func(n, p float64) {
+		if n > 0 {
+			ll += n * math.Log(p)
+		}
+	}
+
+	for k := 0; k <= c.q+1; k++ {
+		if c.less1[k] == 0 && c.greater1[k] == 0 && c.less2[k] == 0 && c.greater2[k] == 0 && c.equal[k] == 0 {
+			continue
+		}
+		term(c.less1[k], c.pmf(a+x, k))
+		term(c.greater2[k], c.pmf(b, k))
+		term(c.less2[k], c.pmf(b+x, k))
+		term(c.greater1[k], c.pmf(a, k))
+		// Either the shared values set the register and neither of the others is higher, or they
+		// stay below k and both others are exactly k.
+		term(c.equal[k], c.pmf(x, k)*c.cdf(a, k)*c.cdf(b, k)+c.cdf(x, k-1)*c.pmf(a, k)*c.pmf(b, k))
+	}
+	return ll
+}
+
+// The range of the logarithm of the cardinalities the maximum likelihood search is restricted to.
+// Cardinalities below 1e-3 round to 0.
+const (
+	minLogCardinality = -7
+	maxLogCardinality = 64 * math.Ln2
+)
+
+// maximize returns the cardinalities with the highest likelihood. It uses the Nelder–Mead method
+// on the logarithm of the cardinalities, which keeps them positive. The likelihood only depends on
+// the counts per register value so evaluating it is cheap.
+func (c *jointCounts) maximize(start [3]float64) [3]float64 {
+	f := func(y [3]float64) float64 {
+		var x [3]float64
+		for i := range y {
+			x[i] = math.Exp(math.Max(minLogCardinality, math.Min(maxLogCardinality, y[i])))
+		}
+		ll := c.logLikelihood(x[0], x[1], x[2])
+		if math.IsNaN(ll) {
+			return math.Inf(1)
+		}
+		return -ll
+	}
+
+	var y0 [3]float64
+	for i, x := range start {
+		y0[i] = math.Log(math.Max(x, 1))
+	}
+
+	y := nelderMead(f, y0, 1, 1e-9, 2000)
+	var x [3]float64
+	for i := range y {
+		x[i] = math.Exp(math.Max(minLogCardinality, math.Min(maxLogCardinality, y[i])))
+	}
+	return x
+}
+
+// nelderMead minimizes f starting with a simplex around x0 with the given step size. It stops when
+// the function values of the simplex differ less than tol, or after maxIter iterations.
+func nelderMead(f func([3]float64) float64, x0 [3]float64, step, tol float64, maxIter int) [3]float64 {
+	const n = 3
+
+	var (
+		points [n + 1][3]float64
+		values [n + 1]float64
+	)
+	for i := range points {
+		points[i] = x0
+		if i > 0 {
+			points[i][i-1] += step
+		}
+		values[i] = f(points[i])
+	}
+
+	// along returns the point c + t*(p - c).
+	along := func(c, p [3]float64, t float64) [3]float64 {
+		var r [3]float64
+		for i := range r {
+			r[i] = c[i] + t*(p[i]-c[i])
+		}
+		return r
+	}
+
+	for iter := 0; iter < maxIter; iter++ {
+		// Sort the points from best to worst.
+		for i := 1; i <= n; i++ {
+			for j := i; j > 0 && values[j] < values[j-1]; j-- {
+				points[j], points[j-1] = points[j-1], points[j]
+				values[j], values[j-1] = values[j-1], values[j]
+			}
+		}
+		if math.Abs(values[n]-values[0]) <= tol*(math.Abs(values[0])+tol) {
+			break
+		}
+
+		var centroid [3]float64
+		for _, p := range points[:n] {
+			for i := range centroid {
+				centroid[i] += p[i] / n
+			}
+		}
+
+		reflected := along(centroid, points[n], -1)
+		fr := f(reflected)
+		switch {
+		case fr < values[0]:
+			expanded := along(centroid, points[n], -2)
+			if fe := f(expanded); fe < fr {
+				points[n], values[n] = expanded, fe
+			} else {
+				points[n], values[n] = reflected, fr
+			}
+		case fr < values[n-1]:
+			points[n], values[n] = reflected, fr
+		default:
+			contracted := along(centroid, points[n], 0.5)
+			if fc := f(contracted); fc < values[n] {
+				points[n], values[n] = contracted, fc
+				continue
+			}
+			// Shrink towards the best point.
+			for i := 1; i <= n; i++ {
+				points[i] = along(points[0], points[i], 0.5)
+				values[i] = f(points[i])
+			}
+		}
+	}
+
+	best := 0
+	for i := range values {
+		if values[i] < values[best] {
+			best = i
+		}
+	}
+	return points[best]
+}
@@ -0,0 +1,141 @@
+package hll
+
+import (
+	"math"
+	mrand "math/rand"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSetOperationsSparse(t *testing.T) {
+	a, b := NewHll(14, 25), NewHll(14, 25)
+	for i := uint64(0); i < 1000; i++ {
+		a.AddUint64Value(i)
+		b.AddUint64Value(i + 500)
+	}
+	beforeA, beforeB := a.Copy(), b.Copy()
+
+	intersection, err := IntersectionCardinality(a, b)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, intersection >= 495 && intersection <= 505, "%d", intersection)
+
+	difference, err := DifferenceCardinality(a, b)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, difference >= 495 && difference <= 505, "%d", difference)
+
+	jaccard, err := Jaccard(a, b)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, math.Abs(jaccard-1.0/3) < 0.01, "%f", jaccard)
+
+	j, err := JointEstimate(a, b)
+	assert.Equal(t, nil, err)
+	for _, x := range []uint64{j.OnlyA, j.OnlyB, j.Both} {
+		assert.Tf(t, x >= 495 && x <= 505, "%+v", j)
+	}
+	assert.Tf(t, math.Abs(j.Jaccard()-1.0/3) < 0.01, "%f", j.Jaccard())
+
+	assert.Equal(t, beforeA, a.Copy())
+	assert.Equal(t, beforeB, b.Copy())
+}
+
+func TestSetOperationsEdgeCases(t *testing.T) {
+	empty := NewHll(14, 25)
+	j, err := JointEstimate(empty, NewHll(14, 25))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, JointCardinality{}, j)
+	assert.Equal(t, float64(0), j.Jaccard())
+
+	jaccard, err := Jaccard(empty, NewHll(14, 25))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(0), jaccard)
+
+	// Different precisions are compared at the lowest one, a dense and a sparse input use the
+	// registers.
+	a, b := NewHll(12, 25), NewHll(10, 20)
+	for i := uint64(0); i < 10000; i++ {
+		a.AddUint64Value(i)
+		if i%50 == 0 {
+			b.AddUint64Value(i)
+		}
+	}
+	assert.T(t, !a.isSparse && b.isSparse)
+
+	j, err = JointEstimate(a, b)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, j.OnlyB < 50, "%+v", j)
+	assert.Tf(t, j.Both > 150 && j.Both < 250, "%+v", j)
+
+	difference, err := DifferenceCardinality(b, a)
+	assert.Equal(t, nil, err)
+	assert.Tf(t, difference < 500, "%d", difference)
+
+	b.SetValueType(ValueTypeInt64)
+	a.SetValueType(ValueTypeBytesOrString)
+	_, err = IntersectionCardinality(a, b)
+	assert.NotEqual(t, nil, err)
+	_, err = JointEstimate(a, b)
+	assert.NotEqual(t, nil, err)
+}
+
+// TestJointEstimateError compares the root mean square error and bias of the intersection estimates
+// of inclusion–exclusion and the joint maximum likelihood estimator.
+func TestJointEstimateError(t *testing.T) {
+	const trials = 20
+
+	r := mrand.New(mrand.NewSource(1))
+	testCases := []struct {
+		p, pPrimeA, pPrimeB uint
+		onlyA, onlyB, both  int
+		sparse              bool
+	}{
+		{10, 25, 25, 9000, 9000, 1000, false},
+		{10, 25, 25, 4000, 4000, 4000, false},
+		{10, 25, 25, 10000, 10000, 0, false},
+		// The elements of a are re-encoded at the pPrime of b.
+		{14, 25, 20, 1000, 1000, 1000, true},
+	}
+
+	for _, testCase := range testCases {
+		var ieSq, mlSq, mlSum float64
+		for i := 0; i < trials; i++ {
+			a, b := NewHll(testCase.p, testCase.pPrimeA), NewHll(testCase.p, testCase.pPrimeB)
+			for j := 0; j < testCase.onlyA; j++ {
+				a.Add(r.Uint64())
+			}
+			for j := 0; j < testCase.onlyB; j++ {
+				b.Add(r.Uint64())
+			}
+			for j := 0; j < testCase.both; j++ {
+				x := r.Uint64()
+				a.Add(x)
+				b.Add(x)
+			}
+			assert.Equalf(t, testCase.sparse, a.isSparse && b.isSparse, "%+v", testCase)
+
+			ie, err := IntersectionCardinality(a, b)
+			assert.Equal(t, nil, err)
+			ml, err := JointEstimate(a, b)
+			assert.Equal(t, nil, err)
+
+			ieSq += math.Pow(float64(ie)-float64(testCase.both), 2)
+			mlSq += math.Pow(float64(ml.Both)-float64(testCase.both), 2)
+			mlSum += float64(ml.Both) - float64(testCase.both)
+		}
+
+		union := float64(testCase.onlyA + testCase.onlyB + testCase.both)
+		stdErr := 1.04 / math.Sqrt(float64(uint64(1)<<testCase.p)) * union
+		ieRMSE, mlRMSE := math.Sqrt(ieSq/trials), math.Sqrt(mlSq/trials)
+		mlBias := mlSum / trials
+		t.Logf("%+v: inclusion–exclusion %.0f, maximum likelihood %.0f with bias %.0f, standard error of the union %.0f",
+			testCase, ieRMSE, mlRMSE, mlBias, stdErr)
+
+		if testCase.sparse {
+			assert.Tf(t, mlRMSE < 0.1*stdErr, "%+v: %f >= %f", testCase, mlRMSE, 0.1*stdErr)
+		} else {
+			assert.Tf(t, mlRMSE < ieRMSE, "%+v: %f >= %f", testCase, mlRMSE, ieRMSE)
+			assert.Tf(t, mlRMSE < 0.6*stdErr, "%+v: %f >= %f", testCase, mlRMSE, 0.6*stdErr)
+		}
+		assert.Tf(t, math.Abs(mlBias) < 0.15*stdErr, "%+v: bias %f >= %f", testCase, mlBias, 0.15*stdErr)
+	}
+}
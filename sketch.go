@@ -0,0 +1,274 @@
+package hll
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// SketchValue is the constraint for the types NewSketch can hash.
+type SketchValue interface {
+	~string | ~[]byte |
+		~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// Sketch is an Hll for values of type T that hashes the values itself, so all sketches of the same
+// type hash their values the same way. Strings and byte slices with the same bytes get the same
+// hash, and so do integers with the same value regardless of their size. Signed integers are sign
+// extended to 64 bits first, so int32(-1) and int64(-1) are the same value.
+//
+// The zero value of a Sketch is an empty Sketch with the default options if T is a SketchValue.
+// For other types the zero value can't be used, its methods panic and decoding into it returns an
+// error. Sketches created with NewSketchFunc can only be decoded into a Sketch created with the same
+// function.
+type Sketch[T any] struct {
+	h         *Hll
+	hash      func(hasher Hasher, v T) uint64
+	valueType ValueType
+}
+
+// NewSketch returns a new Sketch. The opts are the same as for New. Without WithHasher the
+// Sketch uses DefaultHasher. The value type of the Hll is ValueTypeBytesOrString for strings and
+// byte slices, ValueTypeInt64 for signed and ValueTypeUint64 for unsigned integers.
+func NewSketch[T SketchValue](opts ...Option) (*Sketch[T], error) {
+	hash, valueType, err := sketchHash[T]()
+	if err != nil {
+		return nil, err
+	}
+	return newSketch(hash, valueType, opts)
+}
+
+// NewSketchFunc returns a new Sketch for values of any type, for example structs. key returns the
+// bytes to hash for a value, they are hashed the same way as a []byte. Use CompositeKey when a key
+// consists of multiple fields.
+func NewSketchFunc[T any](key func(v T) []byte, opts ...Option) (*Sketch[T], error) {
+	hash := func(hasher Hasher, v T) uint64 {
+		return hasher.HashBytes(key(v))
+	}
+	return newSketch(hash, ValueTypeBytesOrString, opts)
+}
+
+func newSketch[T any](hash func(Hasher, T) uint64, valueType ValueType, opts []Option) (*Sketch[T], error) {
+	h, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	h.valueHasher()
+	h.valueType = valueType
+
+	return &Sketch[T]{h: h, hash: hash, valueType: valueType}, nil
+}
+
+// sketchHash returns the hash function and value type for the kind of T.
+func sketchHash[T any]() (func(Hasher, T) uint64, ValueType, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	switch t.Kind() {
+	case reflect.String:
+		return hashSketchValue[T], ValueTypeBytesOrString, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return hashSketchValue[T], ValueTypeBytesOrString, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return hashSketchValue[T], ValueTypeInt64, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return hashSketchValue[T], ValueTypeUint64, nil
+	}
+
+	return nil, 0, fmt.Errorf("can't hash values of type %v, use NewSketchFunc", t)
+}
+
+// hashSketchValue hashes a value of a type accepted by sketchHash. Only named types, like
+// type userID int32, need reflection.
+func hashSketchValue[T any](hasher Hasher, v T) uint64 {
+	switch v := any(v).(type) {
+	case string:
+		return hasher.HashBytes([]byte(v))
+	case []byte:
+		return hasher.HashBytes(v)
+	case int:
+		return hasher.HashUint64(uint64(v))
+	case int8:
+		return hasher.HashUint64(uint64(v))
+	case int16:
+		return hasher.HashUint64(uint64(v))
+	case int32:
+		return hasher.HashUint64(uint64(v))
+	case int64:
+		return hasher.HashUint64(uint64(v))
+	case uint:
+		return hasher.HashUint64(uint64(v))
+	case uint8:
+		return hasher.HashUint64(uint64(v))
+	case uint16:
+		return hasher.HashUint64(uint64(v))
+	case uint32:
+		return hasher.HashUint64(uint64(v))
+	case uint64:
+		return hasher.HashUint64(v)
+	case uintptr:
+		return hasher.HashUint64(uint64(v))
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return hasher.HashBytes([]byte(rv.String()))
+	case reflect.Slice:
+		return hasher.HashBytes(rv.Bytes())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return hasher.HashUint64(uint64(rv.Int()))
+	default:
+		return hasher.HashUint64(rv.Uint())
+	}
+}
+
+// Add hashes v and adds it.
+func (s *Sketch[T]) Add(v T) {
+	h := s.hll()
+	h.Add(s.hash(h.hasher, v))
+}
+
+// Cardinality returns the estimated number of distinct values.
+func (s *Sketch[T]) Cardinality() uint64 {
+	return s.hll().Cardinality()
+}
+
+// NumValues returns the total number of values that were added, including duplicates.
+func (s *Sketch[T]) NumValues() uint64 {
+	return s.hll().NumValues()
+}
+
+// Merge adds the values of other to s, see Hll.Combine. Like Combine, other may be converted to the
+// dense representation.
+func (s *Sketch[T]) Merge(other *Sketch[T]) error {
+	return s.hll().Combine(other.hll())
+}
+
+// Copy returns a deep copy of the Sketch.
+func (s *Sketch[T]) Copy() *Sketch[T] {
+	h := s.hll().Copy()
+	return &Sketch[T]{h: h, hash: s.hash, valueType: s.valueType}
+}
+
+// Hll returns the underlying Hll. Adding hashes to it directly defeats the purpose of a Sketch.
+func (s *Sketch[T]) Hll() *Hll {
+	return s.hll()
+}
+
+// hll returns the Hll of s, a zero Sketch is initialized first. It panics if T isn't a SketchValue.
+func (s *Sketch[T]) hll() *Hll {
+	if s.h == nil {
+		hash, valueType, err := sketchHash[T]()
+		if err != nil {
+			panic(err)
+		}
+		n, _ := newSketch(hash, valueType, nil)
+		*s = *n
+	}
+	return s.h
+}
+
+// decode replaces the Hll of s with one decoded by f. The decoded Hll must have the value type of
+// s, or no value type. Sketches without a hasher are assumed to use the hasher of s.
+func (s *Sketch[T]) decode(f func(h *Hll) error) error {
+	if s.hash == nil {
+		hash, valueType, err := sketchHash[T]()
+		if err != nil {
+			return err
+		}
+		s.hash, s.valueType = hash, valueType
+	}
+
+	h := &Hll{}
+	if err := f(h); err != nil {
+		return err
+	}
+
+	if h.valueType != ValueTypeUnknown && h.valueType != s.valueType {
+		return fmt.Errorf("value type mismatch: %d/%d", s.valueType, h.valueType)
+	}
+	h.valueType = s.valueType
+	if h.hasher == nil {
+		if s.h != nil && s.h.hasher != nil {
+			h.hasher = s.h.hasher
+		} else {
+			h.hasher = DefaultHasher
+		}
+	}
+
+	// Keep the codec of a Sketch that was created with one.
+	if s.h != nil && s.h.codec != CodecDefault {
+		h.codec = s.h.codec
+	}
+
+	s.h = h
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, see Hll.MarshalBinary.
+func (s *Sketch[T]) MarshalBinary() ([]byte, error) {
+	return s.hll().MarshalBinary()
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, see Hll.UnmarshalBinary.
+func (s *Sketch[T]) UnmarshalBinary(data []byte) error {
+	return s.decode(func(h *Hll) error { return h.UnmarshalBinary(data) })
+}
+
+// WriteTo implements io.WriterTo, see Hll.WriteTo.
+func (s *Sketch[T]) WriteTo(w io.Writer) (int64, error) {
+	return s.hll().WriteTo(w)
+}
+
+// ReadFrom implements io.ReaderFrom, see Hll.ReadFrom.
+func (s *Sketch[T]) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	err := s.decode(func(h *Hll) (err error) {
+		n, err = h.ReadFrom(r)
+		return err
+	})
+	return n, err
+}
+
+// MarshalText implements encoding.TextMarshaler, see Hll.MarshalText.
+func (s *Sketch[T]) MarshalText() ([]byte, error) {
+	return s.hll().MarshalText()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, see Hll.UnmarshalText.
+func (s *Sketch[T]) UnmarshalText(text []byte) error {
+	return s.decode(func(h *Hll) error { return h.UnmarshalText(text) })
+}
+
+// MarshalJSON implements json.Marshaler, see Hll.MarshalJSON.
+func (s *Sketch[T]) MarshalJSON() ([]byte, error) {
+	return s.hll().MarshalJSON()
+}
+
+// UnmarshalJSON implements json.Unmarshaler, see Hll.UnmarshalJSON.
+func (s *Sketch[T]) UnmarshalJSON(buf []byte) error {
+	return s.decode(func(h *Hll) error { return h.UnmarshalJSON(buf) })
+}
+
+// MarshalPb encodes the Sketch as a HllState protobuf message, see Hll.MarshalPb.
+func (s *Sketch[T]) MarshalPb() ([]byte, error) {
+	return s.hll().MarshalPb()
+}
+
+// UnmarshalPb decodes a protobuf message written by MarshalPb, see Hll.UnmarshalPb.
+func (s *Sketch[T]) UnmarshalPb(buf []byte) error {
+	return s.decode(func(h *Hll) error { return h.UnmarshalPb(buf) })
+}
+
+// GobEncode implements gob.GobEncoder, see Hll.GobEncode.
+func (s *Sketch[T]) GobEncode() ([]byte, error) {
+	return s.hll().GobEncode()
+}
+
+// GobDecode implements gob.GobDecoder, see Hll.GobDecode.
+func (s *Sketch[T]) GobDecode(data []byte) error {
+	return s.decode(func(h *Hll) error { return h.GobDecode(data) })
+}
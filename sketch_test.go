@@ -0,0 +1,170 @@
+package hll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+type userID int32
+
+func TestSketchHashing(t *testing.T) {
+	s, err := NewSketch[string](WithHasher(ZetaSketchHasher))
+	assert.Equal(t, nil, err)
+	s.Add("foo")
+	assert.Equal(t, ValueTypeBytesOrString, s.Hll().ValueType())
+
+	// The same as BigQuery's HLL_COUNT.INIT of a STRING column.
+	h, _ := New(WithHasher(ZetaSketchHasher))
+	h.SetValueType(ValueTypeBytesOrString)
+	h.Add(BigQueryHash("foo"))
+	assert.Equal(t, h.Dump(), s.Hll().Dump())
+
+	// Strings and byte slices, and integers of different sizes, get the same hashes.
+	b, _ := NewSketch[[]byte]()
+	b.Add([]byte("foo"))
+	str, _ := NewSketch[string]()
+	str.Add("foo")
+	assert.Equal(t, str.Hll().Dump(), b.Hll().Dump())
+
+	i64, _ := NewSketch[int64]()
+	i64.Add(-1)
+	ids, _ := NewSketch[userID]()
+	ids.Add(-1)
+	assert.Equal(t, ValueTypeInt64, ids.Hll().ValueType())
+	assert.Equal(t, i64.Hll().Dump(), ids.Hll().Dump())
+
+	u, _ := NewSketch[uint8]()
+	u.Add(1)
+	assert.Equal(t, ValueTypeUint64, u.Hll().ValueType())
+	assert.NotEqual(t, nil, i64.Hll().Combine(u.Hll()))
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, _ := NewSketch[int]()
+	b, _ := NewSketch[int]()
+	for i := 0; i < 1000; i++ {
+		a.Add(i)
+		b.Add(i + 500)
+	}
+	assert.Equal(t, nil, a.Merge(b))
+	assert.Equal(t, uint64(2000), a.NumValues())
+
+	est := a.Cardinality()
+	assert.Tf(t, est > 1450 && est < 1550, "%d", est)
+
+	m, _ := NewSketch[int](WithHasher(Murmur3Hasher))
+	assert.NotEqual(t, nil, a.Merge(m))
+}
+
+type sketchKey struct {
+	Region string
+	ID     uint64
+}
+
+func sketchKeyBytes(k sketchKey) []byte {
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], k.ID)
+	return CompositeKey([]byte(k.Region), id[:])
+}
+
+func TestSketchFunc(t *testing.T) {
+	s, err := NewSketchFunc(sketchKeyBytes)
+	assert.Equal(t, nil, err)
+	s.Add(sketchKey{"eu", 1})
+	s.Add(sketchKey{"eu", 1})
+	s.Add(sketchKey{"us", 1})
+	assert.Equal(t, uint64(2), s.Cardinality())
+
+	data, err := s.MarshalBinary()
+	assert.Equal(t, nil, err)
+
+	// A struct sketch can't be decoded into a zero value, it doesn't know the key.
+	assert.NotEqual(t, nil, (&Sketch[sketchKey]{}).UnmarshalBinary(data))
+
+	rt, _ := NewSketchFunc(sketchKeyBytes)
+	assert.Equal(t, nil, rt.UnmarshalBinary(data))
+	rt.Add(sketchKey{"us", 2})
+	assert.Equal(t, uint64(3), rt.Cardinality())
+}
+
+func TestSketchZeroValue(t *testing.T) {
+	var s Sketch[string]
+	c := s.Copy()
+	s.Add("foo")
+	assert.Equal(t, uint64(1), s.Cardinality())
+	assert.Equal(t, uint64(0), c.Cardinality())
+	assert.Equal(t, DefaultHasher, s.Hll().Hasher())
+	assert.Equal(t, ValueTypeBytesOrString, s.Hll().ValueType())
+
+	var other Sketch[string]
+	assert.Equal(t, nil, other.Merge(&s))
+	assert.Equal(t, uint64(1), other.Cardinality())
+
+	// Without a key function there is no way to hash structs.
+	defer func() {
+		assert.NotEqual(t, nil, recover())
+	}()
+	var keys Sketch[sketchKey]
+	keys.Add(sketchKey{"eu", 1})
+}
+
+func TestSketchEncodings(t *testing.T) {
+	type encoding struct {
+		name      string
+		marshal   func(s *Sketch[string]) ([]byte, error)
+		unmarshal func(s *Sketch[string], data []byte) error
+	}
+	encodings := []encoding{
+		{"binary", (*Sketch[string]).MarshalBinary, (*Sketch[string]).UnmarshalBinary},
+		{"text", (*Sketch[string]).MarshalText, (*Sketch[string]).UnmarshalText},
+		{"pb", (*Sketch[string]).MarshalPb, (*Sketch[string]).UnmarshalPb},
+		{"json", func(s *Sketch[string]) ([]byte, error) { return json.Marshal(s) }, func(s *Sketch[string], data []byte) error { return json.Unmarshal(data, s) }},
+		{"gob", func(s *Sketch[string]) ([]byte, error) {
+			var buf bytes.Buffer
+			err := gob.NewEncoder(&buf).Encode(s)
+			return buf.Bytes(), err
+		}, func(s *Sketch[string], data []byte) error { return gob.NewDecoder(bytes.NewReader(data)).Decode(s) }},
+		{"stream", func(s *Sketch[string]) ([]byte, error) {
+			var buf bytes.Buffer
+			_, err := s.WriteTo(&buf)
+			return buf.Bytes(), err
+		}, func(s *Sketch[string], data []byte) error { _, err := s.ReadFrom(bytes.NewReader(data)); return err }},
+	}
+
+	s, _ := NewSketch[string](WithHasher(Murmur3Hasher))
+	s.Add("foo")
+	s.Add("bar")
+
+	for _, e := range encodings {
+		data, err := e.marshal(s)
+		assert.Equalf(t, nil, err, e.name)
+
+		var rt Sketch[string]
+		assert.Equalf(t, nil, e.unmarshal(&rt, data), e.name)
+		assert.Equalf(t, s.Hll().Dump(), rt.Hll().Dump(), e.name)
+
+		rt.Add("baz")
+		assert.Equalf(t, uint64(3), rt.Cardinality(), e.name)
+	}
+
+	// The values were hashed as strings.
+	data, err := s.MarshalBinary()
+	assert.Equal(t, nil, err)
+	var ints Sketch[int]
+	assert.NotEqual(t, nil, ints.UnmarshalBinary(data))
+
+	// Sketches without a hasher use the default.
+	h := NewHll(DefaultP, DefaultPPrime)
+	h.Add(XXHash64Hasher.HashBytes([]byte("foo")))
+	data, _ = h.MarshalBinary()
+	var rt Sketch[string]
+	assert.Equal(t, nil, rt.UnmarshalBinary(data))
+	rt.Add("foo")
+	assert.Equal(t, uint64(1), rt.Cardinality())
+	assert.Equal(t, DefaultHasher, rt.Hll().Hasher())
+}
@@ -0,0 +1,123 @@
+package hll
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SnowflakeP is the precision of Snowflake HLL states. Sketches created by NewHllFromSnowflake also
+// use it as pPrime.
+const SnowflakeP = 12
+
+const snowflakeVersion = 4
+
+// snowflakeState is the object returned by HLL_EXPORT and accepted by HLL_IMPORT.
+// See: https://docs.snowflake.com/en/sql-reference/functions/hll_export
+type snowflakeState struct {
+	Version   int              `json:"version"`
+	Precision uint             `json:"precision"`
+	Sparse    *snowflakeSparse `json:"sparse,omitempty"`
+	Dense     []int            `json:"dense,omitempty"`
+}
+
+type snowflakeSparse struct {
+	Indices     []int `json:"indices"`
+	MaxLzCounts []int `json:"maxLzCounts"`
+}
+
+// NewHllFromSnowflake decodes the JSON object returned by the HLL_EXPORT function in Snowflake. The
+// resulting Hll has p and pPrime SnowflakeP.
+//
+// Snowflake doesn't document how it hashes values, only Hlls that contain registers computed by
+// Snowflake should be combined with the result.
+func NewHllFromSnowflake(data []byte) (*Hll, error) {
+	var s snowflakeState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	if s.Version != snowflakeVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, s.Version)
+	}
+	if s.Precision != SnowflakeP {
+		return nil, fmt.Errorf("%w: %d", ErrBadPrecision, s.Precision)
+	}
+
+	h := NewHll(SnowflakeP, SnowflakeP)
+	maxRhoW := 64 - SnowflakeP + 1
+
+	switch {
+	case s.Sparse != nil && s.Dense != nil:
+		return nil, fmt.Errorf("%w: both sparse and dense", ErrMalformed)
+	case s.Sparse != nil:
+		if len(s.Sparse.Indices) != len(s.Sparse.MaxLzCounts) {
+			return nil, fmt.Errorf("%w: %d indices but %d maxLzCounts", ErrCorruptSparse, len(s.Sparse.Indices), len(s.Sparse.MaxLzCounts))
+		}
+		for i, idx := range s.Sparse.Indices {
+			r := s.Sparse.MaxLzCounts[i]
+			if idx < 0 || uint64(idx) >= h.m || r < 1 || r > maxRhoW {
+				return nil, fmt.Errorf("%w: register %d has value %d", ErrCorruptSparse, idx, r)
+			}
+			h.addHash(decodeNormalToHash(uint64(idx), uint8(r), SnowflakeP))
+		}
+		h.mergeTmpSetIfAny()
+	case s.Dense != nil:
+		if uint64(len(s.Dense)) != h.m {
+			return nil, fmt.Errorf("%w: expected %d registers, got %d", ErrCorruptDense, h.m, len(s.Dense))
+		}
+		h.switchToNormal()
+		for i, r := range s.Dense {
+			if r < 0 || r > maxRhoW {
+				return nil, fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, i, r)
+			}
+			h.bigM.Set(uint64(i), uint8(r))
+		}
+	}
+
+	return h, nil
+}
+
+// MarshalSnowflake encodes the Hll as a JSON object that can be passed to the HLL_IMPORT function in
+// Snowflake. Sparse sketches use the sparse form.
+//
+// An Hll with a p above SnowflakeP is downsampled first. A lower p can't be converted and results in
+// an error.
+func (h *Hll) MarshalSnowflake() ([]byte, error) {
+	if h.p < SnowflakeP {
+		return nil, fmt.Errorf("precision %d is lower than the Snowflake precision %d", h.p, SnowflakeP)
+	}
+
+	d := h
+	if h.p > SnowflakeP {
+		var err error
+		if d, err = h.Downsample(SnowflakeP, h.pPrime); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mergeTmpSetIfAny()
+
+	s := snowflakeState{
+		Version:   snowflakeVersion,
+		Precision: SnowflakeP,
+	}
+
+	if d.isSparse {
+		// Multiple sparse elements can map to the same register, the register value is the maximum.
+		s.Sparse = &snowflakeSparse{Indices: []int{}, MaxLzCounts: []int{}}
+		M := toNormal(d.sparseList, d.p, d.pPrime)
+		for i := uint64(0); i < d.m; i++ {
+			if r := M.Get(i); r > 0 {
+				s.Sparse.Indices = append(s.Sparse.Indices, int(i))
+				s.Sparse.MaxLzCounts = append(s.Sparse.MaxLzCounts, int(r))
+			}
+		}
+	} else {
+		s.Dense = make([]int, d.m)
+		for i := range s.Dense {
+			s.Dense[i] = int(d.bigM.Get(uint64(i)))
+		}
+	}
+
+	return json.Marshal(s)
+}
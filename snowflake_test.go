@@ -0,0 +1,104 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSnowflake_Sparse(t *testing.T) {
+	data := `{"version":4,"precision":12,"sparse":{"indices":[223,736,976],"maxLzCounts":[2,1,3]}}`
+
+	h, err := NewHllFromSnowflake([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := h.Cardinality(); c != 3 {
+		t.Errorf("expected cardinality 3 got %d", c)
+	}
+
+	M := registers(h)
+	if M.Get(223) != 2 || M.Get(736) != 1 || M.Get(976) != 3 {
+		t.Errorf("expected registers 2, 1 and 3 got %d, %d and %d", M.Get(223), M.Get(736), M.Get(976))
+	}
+
+	out, err := h.MarshalSnowflake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != data {
+		t.Errorf("expected %s got %s", data, out)
+	}
+}
+
+func TestSnowflake_RoundTrip(t *testing.T) {
+	for _, p := range []uint{12, 14} {
+		for _, n := range []int{0, 10, 1000, 100000} {
+			t.Run(fmt.Sprintf("p%d-%d", p, n), func(t *testing.T) {
+				h := NewHll(p, 25)
+				for i := 0; i < n; i++ {
+					h.Add(rand.Uint64())
+				}
+
+				data, err := h.MarshalSnowflake()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				h2, err := NewHllFromSnowflake(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				expected, err := h.Downsample(SnowflakeP, 25)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				M, M2 := registers(expected), registers(h2)
+				for i := uint64(0); i < expected.m; i++ {
+					if M.Get(i) != M2.Get(i) {
+						t.Fatalf("register %d: expected %d got %d", i, M.Get(i), M2.Get(i))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSnowflake_Errors(t *testing.T) {
+	dense := func(last string) string {
+		return `{"version":4,"precision":12,"dense":[` + strings.Repeat("0,", 4095) + last + `]}`
+	}
+
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"json", `{"version":`, ErrMalformed},
+		{"version", `{"version":3,"precision":12}`, ErrUnsupportedVersion},
+		{"precision", `{"version":4,"precision":14}`, ErrBadPrecision},
+		{"both", `{"version":4,"precision":12,"sparse":{"indices":[],"maxLzCounts":[]},"dense":[]}`, ErrMalformed},
+		{"sparse lengths", `{"version":4,"precision":12,"sparse":{"indices":[1,2],"maxLzCounts":[1]}}`, ErrCorruptSparse},
+		{"sparse index", `{"version":4,"precision":12,"sparse":{"indices":[4096],"maxLzCounts":[1]}}`, ErrCorruptSparse},
+		{"sparse value", `{"version":4,"precision":12,"sparse":{"indices":[1],"maxLzCounts":[0]}}`, ErrCorruptSparse},
+		{"dense length", `{"version":4,"precision":12,"dense":[1,2,3]}`, ErrCorruptDense},
+		{"dense value", dense("54"), ErrCorruptDense},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewHllFromSnowflake([]byte(test.data)); !errors.Is(err, test.err) {
+				t.Errorf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, err := NewHllFromSnowflake([]byte(dense("53"))); err != nil {
+		t.Errorf("expected no error got %v", err)
+	}
+}
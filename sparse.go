@@ -5,8 +5,6 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
-
-	"github.com/golang/snappy"
 )
 
 type sparse struct {
@@ -80,8 +78,8 @@ type jsonableSparse struct {
 	L, N uint64
 }
 
-func (s *sparse) MarshalJSON() ([]byte, error) {
-	compressed, err := snappyB64(s.buf)
+func (s *sparse) marshalJSON(c Codec) ([]byte, error) {
+	compressed, err := compressB64(c, s.buf)
 	if err != nil {
 		return nil, err
 	}
@@ -89,13 +87,13 @@ func (s *sparse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(j)
 }
 
-func (s *sparse) UnmarshalJSON(buf []byte) error {
+func (s *sparse) unmarshalJSON(buf []byte, c Codec, maxSize int) error {
 	j := jsonableSparse{}
 	if err := json.Unmarshal(buf, &j); err != nil {
 		return err
 	}
 
-	uncompressed, err := unsnappyB64(j.B)
+	uncompressed, err := decompressB64(c, j.B, maxSize)
 	if err != nil {
 		return err
 	}
@@ -104,31 +102,24 @@ func (s *sparse) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
-// Compress the input using snapp and encode the result using URL-safe base64.
-func snappyB64(in []byte) ([]byte, error) {
-	compressed := snappy.Encode(nil, in)
+// Compress the input using the codec and encode the result using URL-safe base64.
+func compressB64(c Codec, in []byte) ([]byte, error) {
+	compressed, err := compress(c, in)
+	if err != nil {
+		return nil, err
+	}
 	outBuf := make([]byte, base64.URLEncoding.EncodedLen(len(compressed)))
 	base64.URLEncoding.Encode(outBuf, compressed)
 	return outBuf, nil
 }
 
-// The inverse of snappyB64.
-func unsnappyB64(in []byte) ([]byte, error) {
+// The inverse of compressB64.
+func decompressB64(c Codec, in []byte, maxSize int) ([]byte, error) {
 	unBase64ed := make([]byte, base64.URLEncoding.DecodedLen(len(in)))
 	n, err := base64.URLEncoding.Decode(unBase64ed, in)
 	if err != nil {
 		return nil, err
 	}
 
-	uncompressed, err := snappy.Decode(nil, unBase64ed[:n])
-	if err != nil {
-		return nil, err
-	}
-
-	// The snappy library returns nil when the output length is zero. Fix it now.
-	// I filed this bug upstream: https://code.google.com/p/snappy-go/issues/detail?id=6
-	if uncompressed == nil {
-		uncompressed = []byte{}
-	}
-	return uncompressed, nil
+	return decompress(c, unBase64ed[:n], maxSize)
 }
@@ -61,6 +61,26 @@ func decodeSparseHash(k uint64, p, pPrime uint) (idx uint64, rhoW uint8) {
 	return ((k ^ rhoEncodedFlag) >> RHOW_BITS) << (pPrime - p), uint8(k & RHOW_MASK)
 }
 
+// validSparseHash returns whether k could have been returned by encodeSparseHash.
+func validSparseHash(k uint64, p, pPrime uint) bool {
+	var rhoEncodedFlag uint64
+	if pPrime >= p+RHOW_BITS {
+		rhoEncodedFlag = uint64(1) << pPrime
+	} else {
+		rhoEncodedFlag = uint64(1) << (p + RHOW_BITS)
+	}
+
+	if k&rhoEncodedFlag == 0 {
+		// The rhoW is derived from the index, so the bits below p can't all be zero.
+		mask := (uint64(1) << (pPrime - p)) - 1
+		return k < uint64(1)<<pPrime && k&mask != 0
+	}
+
+	k ^= rhoEncodedFlag
+	r := k & RHOW_MASK
+	return k>>RHOW_BITS < uint64(1)<<p && r > 0 && r <= uint64(64-pPrime+1)
+}
+
 func decodeSparseHashForNormal(k uint64, p, pPrime uint) (idx uint64, rhoW uint8) {
 	var rhoEncodedFlag uint64
 	if pPrime >= p+RHOW_BITS {
@@ -76,6 +96,33 @@ func decodeSparseHashForNormal(k uint64, p, pPrime uint) (idx uint64, rhoW uint8
 	return (k ^ rhoEncodedFlag) >> RHOW_BITS, uint8((k & RHOW_MASK) + uint64(pPrime) - uint64(p))
 }
 
+// decodeSparseHashToHash returns a hash that encodes to k. This allows an encoded hash to be
+// re-encoded for a different p and pPrime. Bits that aren't stored in k are chosen to make rhoW as
+// small as possible.
+func decodeSparseHashToHash(k uint64, p, pPrime uint) uint64 {
+	idx, r := decodeSparseHash(k, p, pPrime)
+	if r == 0 {
+		// rhoW isn't stored if it can be derived from the index. The bits after pPrime are unknown in
+		// that case and we assume the first one is set.
+		r = 1
+	}
+	return idx<<(64-pPrime) | rhoWToBits(r, uint8(64-pPrime))
+}
+
+// decodeNormalToHash returns a hash that results in rhoW r in register idx.
+func decodeNormalToHash(idx uint64, r uint8, p uint) uint64 {
+	return idx<<(64-p) | rhoWToBits(r, uint8(64-p))
+}
+
+// rhoWToBits is the inverse of computeRhoW. It returns the lowest bts bits of a value with the
+// given rhoW.
+func rhoWToBits(r uint8, bts uint8) uint64 {
+	if r > bts {
+		return 0
+	}
+	return uint64(1) << (bts - r)
+}
+
 type mergeElem struct {
 	index   uint64
 	rho     uint8
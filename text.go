@@ -0,0 +1,245 @@
+package hll
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// textPrefix starts the compact text encoding, the rest of the token is the binary encoding in
+// unpadded URL safe base64. It only uses characters that don't need quoting in flags, YAML or
+// environment variables.
+const textPrefix = "hll:"
+
+// MarshalText implements encoding.TextMarshaler. The result is a single token without whitespace,
+// use Dump for a readable representation.
+func (h *Hll) MarshalText() ([]byte, error) {
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	text := make([]byte, len(textPrefix)+base64.RawURLEncoding.EncodedLen(len(data)))
+	copy(text, textPrefix)
+	base64.RawURLEncoding.Encode(text[len(textPrefix):], data)
+	return text, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts both the token returned by
+// MarshalText and the output of Dump.
+func (h *Hll) UnmarshalText(text []byte) error {
+	text = bytes.TrimSpace(text)
+	if !bytes.HasPrefix(text, []byte(textPrefix)) {
+		return h.parseDump(text)
+	}
+
+	data := make([]byte, base64.RawURLEncoding.DecodedLen(len(text)-len(textPrefix)))
+	n, err := base64.RawURLEncoding.Decode(data, text[len(textPrefix):])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return h.UnmarshalBinary(data[:n])
+}
+
+// Dump returns a multi-line description of the Hll that is meant to be read and written by
+// humans, for example to write test cases. It can be parsed again with UnmarshalText which results
+// in an identical Hll. The format is:
+//
+//	hll
+//	p 10
+//	pPrime 20
+//	numValues 3
+//	valueType 2
+//	hasher xxhash64
+//	representation sparse
+//	entry 1235 -
+//	entry 5120 7
+//
+// Sparse entries contain the index with pPrime bits and the rhoW. The rhoW is - when the index
+// doesn't end with pPrime-p zero bits, in which case the register value follows from the index.
+// The entries of a dense Hll are the registers that aren't zero:
+//
+//	representation dense
+//	register 3 1
+//
+// The hasher line is only present if the Hll has a hasher. Empty lines and lines starting with #
+// are ignored.
+func (h *Hll) Dump() string {
+	h.mergeTmpSetIfAny()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "hll\np %d\npPrime %d\nnumValues %d\nvalueType %d\n", h.p, h.pPrime, h.numValues, h.valueType)
+	if h.hasher != nil {
+		fmt.Fprintf(&b, "hasher %s\n", h.hasher.Name())
+	}
+
+	if h.isSparse {
+		b.WriteString("representation sparse\n")
+
+		it := h.sparseList.GetIterator()
+		for {
+			k, ok := it()
+			if !ok {
+				break
+			}
+
+			idx, r := decodeSparseHash(k, h.p, h.pPrime)
+			if r == 0 {
+				fmt.Fprintf(&b, "entry %d -\n", idx)
+			} else {
+				fmt.Fprintf(&b, "entry %d %d\n", idx, r)
+			}
+		}
+	} else {
+		b.WriteString("representation dense\n")
+
+		for i := uint64(0); i < h.m; i++ {
+			if r := h.bigM.Get(i); r > 0 {
+				fmt.Fprintf(&b, "register %d %d\n", i, r)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+func (h *Hll) parseDump(text []byte) error {
+	var (
+		d         *Hll
+		p, pPrime uint64
+		numValues uint64
+		valueType int64
+		hasher    Hasher
+		err       error
+	)
+
+	seen := map[string]bool{}
+	lineNum := 0
+
+	s := bufio.NewScanner(bytes.NewReader(text))
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		key := fields[0]
+
+		if len(seen) == 0 && (key != "hll" || len(fields) != 1) {
+			return fmt.Errorf("%w: line %d: expected hll", ErrMalformed, lineNum)
+		}
+		if seen[key] && key != "entry" && key != "register" {
+			return fmt.Errorf("%w: line %d: duplicate %s", ErrMalformed, lineNum, key)
+		}
+		seen[key] = true
+
+		switch {
+		case key == "hll":
+		case len(fields) != 2 && key != "entry" && key != "register":
+			return fmt.Errorf("%w: line %d: expected a single value", ErrMalformed, lineNum)
+		case d == nil && key == "p":
+			p, err = strconv.ParseUint(fields[1], 10, 8)
+		case d == nil && key == "pPrime":
+			pPrime, err = strconv.ParseUint(fields[1], 10, 8)
+		case d == nil && key == "numValues":
+			numValues, err = strconv.ParseUint(fields[1], 10, 64)
+		case d == nil && key == "valueType":
+			valueType, err = strconv.ParseInt(fields[1], 10, 32)
+		case d == nil && key == "hasher":
+			hasher, err = lookupHasher(fields[1])
+		case d == nil && key == "representation":
+			if !seen["p"] || !seen["pPrime"] {
+				return fmt.Errorf("%w: line %d: p and pPrime have to come first", ErrMalformed, lineNum)
+			}
+			if d, err = New(WithPrecision(uint(p)), WithSparsePrecision(uint(pPrime))); err != nil {
+				return err
+			}
+			d.numValues = numValues
+			d.valueType = ValueType(valueType)
+			d.hasher = hasher
+
+			switch fields[1] {
+			case "sparse":
+			case "dense":
+				d.switchToNormal()
+			default:
+				return fmt.Errorf("%w: line %d: unknown representation %s", ErrUnsupportedType, lineNum, fields[1])
+			}
+		case d != nil && d.isSparse && key == "entry" && len(fields) == 3:
+			err = d.parseDumpEntry(fields[1], fields[2])
+		case d != nil && !d.isSparse && key == "register" && len(fields) == 3:
+			err = d.parseDumpRegister(fields[1], fields[2])
+		default:
+			return fmt.Errorf("%w: line %d: unexpected %s", ErrMalformed, lineNum, key)
+		}
+		if numErr := (*strconv.NumError)(nil); errors.As(err, &numErr) {
+			err = fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if d == nil {
+		return fmt.Errorf("%w: missing representation", ErrMalformed)
+	}
+
+	d.mergeTmpSetIfAny()
+	*h = *d
+	return nil
+}
+
+func (h *Hll) parseDumpEntry(idxField, rField string) error {
+	idx, err := strconv.ParseUint(idxField, 10, 32)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptSparse, err)
+	}
+
+	var r uint64
+	if rField != "-" {
+		if r, err = strconv.ParseUint(rField, 10, 8); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptSparse, err)
+		}
+	}
+
+	// The rhoW is only stored when it doesn't follow from the index.
+	mask := uint64(1)<<(h.pPrime-h.p) - 1
+	if idx >= h.mPrime || (idx&mask == 0) != (rField != "-") {
+		return fmt.Errorf("%w: invalid entry %d %s", ErrCorruptSparse, idx, rField)
+	}
+
+	k := uint64(encode(uint32(idx), uint8(r), h.p, h.pPrime))
+	if !validSparseHash(k, h.p, h.pPrime) {
+		return fmt.Errorf("%w: invalid entry %d %s", ErrCorruptSparse, idx, rField)
+	}
+
+	// Entries can be in any order, mergeTmpSetIfAny sorts them and keeps the highest rhoW.
+	h.tempSet = append(h.tempSet, k)
+	return nil
+}
+
+func (h *Hll) parseDumpRegister(idxField, rField string) error {
+	idx, err := strconv.ParseUint(idxField, 10, 32)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptDense, err)
+	}
+	r, err := strconv.ParseUint(rField, 10, 8)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptDense, err)
+	}
+
+	if idx >= h.m || r > uint64(64-h.p+1) {
+		return fmt.Errorf("%w: register %d has value %d", ErrCorruptDense, idx, r)
+	}
+
+	h.bigM.Set(idx, maxU8(h.bigM.Get(idx), uint8(r)))
+	return nil
+}
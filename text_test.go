@@ -0,0 +1,104 @@
+package hll
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestTextRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 10, 10000} {
+		h := NewHll(10, 20)
+		h.SetValueType(ValueTypeBytesOrString)
+		for i := 0; i < n; i++ {
+			h.Add(randUint64(t))
+		}
+
+		text, err := h.MarshalText()
+		assert.Equal(t, nil, err)
+		assert.T(t, strings.HasPrefix(string(text), "hll:"))
+		assert.Equal(t, -1, strings.IndexAny(string(text), " \n\t=+/"))
+
+		rt := &Hll{}
+		assert.Equal(t, nil, rt.UnmarshalText(text))
+		assert.Equal(t, h.Dump(), rt.Dump())
+
+		rt = &Hll{}
+		assert.Equal(t, nil, rt.UnmarshalText([]byte(h.Dump())))
+		assert.Equal(t, h.isSparse, rt.isSparse)
+		assert.Equal(t, h.Cardinality(), rt.Cardinality())
+		assert.Equal(t, h.NumValues(), rt.NumValues())
+		assert.Equal(t, h.ValueType(), rt.ValueType())
+		assert.Equal(t, registers(h), registers(rt))
+
+		if h.isSparse {
+			assert.Equal(t, h.sparseList.buf, rt.sparseList.buf)
+		} else {
+			assert.Equal(t, h.bigM, rt.bigM)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	h := NewHll(4, 10)
+	h.SetValueType(ValueTypeInt64)
+	h.Add(1<<60 | 1<<54) // Index 1 followed by 000001, so the rhoW follows from the index.
+	h.Add(2<<60 | 1<<50) // Index 2 followed by 000000, so the rhoW of 1<<50 is stored.
+
+	expected := "hll\np 4\npPrime 10\nnumValues 2\nvalueType 2\nrepresentation sparse\nentry 65 -\nentry 128 4\n"
+	assert.Equal(t, expected, h.Dump())
+
+	h.switchToNormal()
+	expected = "hll\np 4\npPrime 10\nnumValues 2\nvalueType 2\nrepresentation dense\nregister 1 6\nregister 2 10\n"
+	assert.Equal(t, expected, h.Dump())
+}
+
+func TestParseDump(t *testing.T) {
+	// Hand written entries don't have to be sorted and can contain duplicates.
+	text := `
+		# Test case
+		hll
+		p 4
+		pPrime 10
+		representation sparse
+		entry 128 5
+		entry 65 -
+		entry 128 3
+	`
+
+	h := &Hll{}
+	assert.Equal(t, nil, h.UnmarshalText([]byte(text)))
+	assert.Equal(t, "hll\np 4\npPrime 10\nnumValues 0\nvalueType 0\nrepresentation sparse\nentry 65 -\nentry 128 5\n", h.Dump())
+
+	testCases := []struct {
+		name string
+		text string
+		err  error
+	}{
+		{"empty", "", ErrMalformed},
+		{"missing hll", "p 4\npPrime 4\nrepresentation sparse", ErrMalformed},
+		{"missing p", "hll\npPrime 4\nrepresentation sparse", ErrMalformed},
+		{"bad p", "hll\np x\npPrime 4\nrepresentation sparse", ErrMalformed},
+		{"precision", "hll\np 4\npPrime 3\nrepresentation sparse", ErrBadPrecision},
+		{"duplicate", "hll\np 4\np 4\npPrime 4\nrepresentation sparse", ErrMalformed},
+		{"representation", "hll\np 4\npPrime 4\nrepresentation other", ErrUnsupportedType},
+		{"register in sparse", "hll\np 4\npPrime 4\nrepresentation sparse\nregister 1 1", ErrMalformed},
+		{"entry in dense", "hll\np 4\npPrime 4\nrepresentation dense\nentry 1 1", ErrMalformed},
+		{"missing rhoW", "hll\np 4\npPrime 10\nrepresentation sparse\nentry 128 -", ErrCorruptSparse},
+		{"unexpected rhoW", "hll\np 4\npPrime 10\nrepresentation sparse\nentry 65 1", ErrCorruptSparse},
+		{"rhoW too high", "hll\np 4\npPrime 10\nrepresentation sparse\nentry 128 56", ErrCorruptSparse},
+		{"entry index", "hll\np 4\npPrime 10\nrepresentation sparse\nentry 1024 1", ErrCorruptSparse},
+		{"register index", "hll\np 4\npPrime 4\nrepresentation dense\nregister 16 1", ErrCorruptDense},
+		{"register value", "hll\np 4\npPrime 4\nrepresentation dense\nregister 1 62", ErrCorruptDense},
+		{"token", "hll:!", ErrMalformed},
+	}
+
+	for _, testCase := range testCases {
+		err := (&Hll{}).UnmarshalText([]byte(testCase.text))
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.err, err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package hll
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+)
+
+// Union returns the union of the sketches without modifying them, unlike Combine. The sparse lists
+// of all sparse inputs are merged in a single pass, and the result is converted to the dense
+// representation at most once. The same rules as for Combine apply: the result has the lowest p and
+// pPrime of the inputs, and all known value types and hashers must be the same. The result uses
+// the default thresholds of NewHll and the codec of the first input.
+func Union(sketches ...*Hll) (*Hll, error) {
+	u, err := newUnion(sketches)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newHll(u.p, u.pPrime)
+	h.numValues = u.numValues
+	h.valueType = u.valueType
+	h.hasher = u.hasher
+	h.codec = sketches[0].codec
+
+	if len(u.dense) == 0 {
+		h.sparseList = newSparse(u.sizeEst)
+		u.merge(h.sparseList.Add)
+		if h.sparseList.SizeInBits() > h.sparseThresholdBits {
+			h.switchToNormal()
+		}
+		return h, nil
+	}
+
+	h.isSparse = false
+	h.sparseList = nil
+	h.bigM = newNormal(h.m)
+	u.registers(nil, func(i uint64, r uint8) {
+		if r > 0 {
+			h.bigM.Set(i, r)
+		}
+	})
+	return h, nil
+}
+
+// UnionCardinality returns the cardinality of Union(sketches...) without creating the union. Only
+// inputs that have a different precision than the union, or elements that haven't been merged into
+// their sparse list yet, are copied.
+func UnionCardinality(sketches ...*Hll) (uint64, error) {
+	u, err := newUnion(sketches)
+	if err != nil {
+		return 0, err
+	}
+	return u.cardinality(), nil
+}
+
+// cardinality returns the cardinality of the union.
+func (u *union) cardinality() uint64 {
+	est := Hll{p: u.p, pPrime: u.pPrime, m: 1 << u.p, mPrime: 1 << u.pPrime}
+	est.alpha = alphaForM(est.m)
+
+	// Compute the size of the merged sparse list to know whether Union would be sparse, while
+	// computing the dense estimate in the same pass.
+	var (
+		n, size, last uint64
+		inverseSum    float64
+		V             uint64
+	)
+	u.registers(func(k uint64) {
+		size += uint64(uvarintLen(k - last))
+		last = k
+		n++
+	}, func(i uint64, r uint8) {
+		inverseSum += 1 / lookupTable[r]
+		if r == 0 {
+			V++
+		}
+	})
+
+	if len(u.dense) == 0 && size*8 <= est.m*6 {
+		return linearCounting(est.mPrime, est.mPrime-n)
+	}
+	return est.estimateNormal(inverseSum, V)
+}
+
+// union holds the inputs of Union in a form that can be iterated at the precision of the union.
+type union struct {
+	p, pPrime uint
+	numValues uint64
+	valueType ValueType
+	hasher    Hasher
+
+	// The sorted sparse inputs at the precision of the union.
+	lists  []*sparse
+	slices [][]uint64
+	// sizeEst is the size of the largest sparse input.
+	sizeEst uint64
+
+	dense []*Hll
+}
+
+func newUnion(sketches []*Hll) (*union, error) {
+	if len(sketches) == 0 {
+		return nil, fmt.Errorf("no sketches")
+	}
+
+	u := &union{p: sketches[0].p, pPrime: sketches[0].pPrime}
+	for _, h := range sketches {
+		if h.valueType != ValueTypeUnknown {
+			if u.valueType != ValueTypeUnknown && u.valueType != h.valueType {
+				return nil, fmt.Errorf("value type mismatch: %d/%d", u.valueType, h.valueType)
+			}
+			u.valueType = h.valueType
+		}
+		if h.hasher != nil {
+			if u.hasher != nil && u.hasher.Name() != h.hasher.Name() {
+				return nil, fmt.Errorf("hasher mismatch: %s/%s", u.hasher.Name(), h.hasher.Name())
+			}
+			u.hasher = h.hasher
+		}
+
+		u.p = minUint(u.p, h.p)
+		u.pPrime = minUint(u.pPrime, h.pPrime)
+		u.numValues += h.numValues
+	}
+
+	for _, h := range sketches {
+		u.add(h)
+	}
+	return u, nil
+}
+
+// add adds an input, its precision must be at least the precision of the union.
+func (u *union) add(h *Hll) {
+	if !h.isSparse {
+		u.dense = append(u.dense, h)
+		return
+	}
+
+	u.sizeEst = maxU64(u.sizeEst, h.sparseList.SizeInBytes())
+
+	if h.p == u.p && h.pPrime == u.pPrime {
+		u.lists = append(u.lists, h.sparseList)
+		if len(h.tempSet) > 0 {
+			tempSet := make([]uint64, len(h.tempSet))
+			copy(tempSet, h.tempSet)
+			sortHashcodesByIndex(tempSet, u.p, u.pPrime)
+			u.slices = append(u.slices, tempSet)
+		}
+		return
+	}
+
+	// Re-encode the elements at the precision of the union, the same way changePrecision does.
+	elements := make([]uint64, 0, h.sparseList.GetNumElements()+uint64(len(h.tempSet)))
+	it := h.sparseList.GetIterator()
+	for {
+		k, ok := it()
+		if !ok {
+			break
+		}
+		elements = append(elements, u.reencode(h, k))
+	}
+	for _, k := range h.tempSet {
+		elements = append(elements, u.reencode(h, k))
+	}
+	sortHashcodesByIndex(elements, u.p, u.pPrime)
+	u.slices = append(u.slices, elements)
+}
+
+// single returns a union of only h at the precision of u.
+func (u *union) single(h *Hll) *union {
+	s := &union{p: u.p, pPrime: u.pPrime, numValues: h.numValues, valueType: h.valueType, hasher: h.hasher}
+	s.add(h)
+	return s
+}
+
+func (u *union) reencode(h *Hll, k uint64) uint64 {
+	x := decodeSparseHashToHash(k, h.p, h.pPrime)
+	return uint64(encodeSparseHash(x, u.p, u.pPrime))
+}
+
+// merge calls f for every element of the merged sparse inputs, in the order of the sparse list.
+// Of elements with the same index only the one with the highest rhoW is kept, like merge does.
+func (u *union) merge(f func(k uint64)) {
+	var heads mergeHeap
+	add := func(it u64It) {
+		elemIt := makeMergeElemIter(u.p, u.pPrime, it)
+		if elem, ok := elemIt(); ok {
+			heads = append(heads, mergeHead{elem, elemIt})
+		}
+	}
+	for _, s := range u.lists {
+		add(s.GetIterator())
+	}
+	for _, s := range u.slices {
+		add(makeU64SliceIt(s))
+	}
+	heap.Init(&heads)
+
+	first := true
+	var lastIndex uint64
+	for len(heads) > 0 {
+		elem := heads[0].elem
+		if next, ok := heads[0].it(); ok {
+			heads[0].elem = next
+			heap.Fix(&heads, 0)
+		} else {
+			heap.Pop(&heads)
+		}
+
+		// The heap returns the element with the highest rhoW first.
+		if !first && elem.index == lastIndex {
+			continue
+		}
+		first = false
+		lastIndex = elem.index
+		f(elem.encoded)
+	}
+}
+
+// registers calls f for every dense register of the union in order, including zero registers. If
+// each isn't nil it is called for every merged sparse element as well.
+func (u *union) registers(each func(k uint64), f func(i uint64, r uint8)) {
+	m := uint64(1) << u.p
+
+	// The merged sparse elements are ordered by index, so they are ordered by register too.
+	var (
+		i       uint64
+		current uint8
+	)
+	flush := func(next uint64) {
+		for ; i < next; i++ {
+			r := current
+			for _, d := range u.dense {
+				r = maxU8(r, denseRegister(d, i, u.p))
+			}
+			f(i, r)
+			current = 0
+		}
+	}
+	u.merge(func(k uint64) {
+		if each != nil {
+			each(k)
+		}
+		idx, r := decodeSparseHashForNormal(k, u.p, u.pPrime)
+		flush(idx)
+		current = maxU8(current, r)
+	})
+	flush(m)
+}
+
+// denseRegister returns register i of the dense Hll h at precision p, which is at most h.p.
+func denseRegister(h *Hll, i uint64, p uint) uint8 {
+	if h.p == p {
+		return h.bigM.Get(i)
+	}
+
+	// Register i at p is the combination of 2^(h.p-p) registers at h.p, see changePrecision.
+	var r uint8
+	shift := h.p - p
+	for j := i << shift; j < (i+1)<<shift; j++ {
+		if v := h.bigM.Get(j); v > 0 {
+			x := decodeNormalToHash(j, v, h.p)
+			r = maxU8(r, computeRhoW(x, uint8(64-p)))
+		}
+	}
+	return r
+}
+
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+type mergeHead struct {
+	elem mergeElem
+	it   mergeElemIt
+}
+
+// mergeHeap orders the next elements of the merged iterators by index, and by descending rhoW for
+// the same index.
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].elem.index != h[j].elem.index {
+		return h[i].elem.index < h[j].elem.index
+	}
+	return h[i].elem.rho > h[j].elem.rho
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(mergeHead)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,126 @@
+package hll
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func newUnionInput(r *mrand.Rand, p, pPrime uint, n int) *Hll {
+	h := NewHll(p, pPrime)
+	for i := 0; i < n; i++ {
+		h.Add(r.Uint64())
+	}
+	return h
+}
+
+func TestUnion(t *testing.T) {
+	r := mrand.New(mrand.NewSource(1))
+
+	testCases := []struct {
+		name   string
+		inputs []*Hll
+	}{
+		{"single", []*Hll{newUnionInput(r, 14, 25, 100)}},
+		{"empty", []*Hll{NewHll(14, 25), NewHll(14, 25)}},
+		{"sparse", []*Hll{
+			newUnionInput(r, 14, 25, 100),
+			newUnionInput(r, 14, 25, 1000),
+			newUnionInput(r, 14, 25, 10), // Elements in the temp set.
+		}},
+		{"sparse to dense", []*Hll{
+			newUnionInput(r, 10, 25, 150),
+			newUnionInput(r, 10, 25, 150),
+			newUnionInput(r, 10, 25, 150),
+		}},
+		{"dense", []*Hll{
+			newUnionInput(r, 10, 25, 5000),
+			newUnionInput(r, 10, 25, 5000),
+		}},
+		{"mixed", []*Hll{
+			newUnionInput(r, 10, 25, 50),
+			newUnionInput(r, 10, 25, 5000),
+			newUnionInput(r, 10, 25, 5),
+		}},
+		{"precision", []*Hll{
+			newUnionInput(r, 14, 25, 1000),
+			newUnionInput(r, 12, 20, 500),
+			newUnionInput(r, 13, 25, 20000),
+			newUnionInput(r, 16, 25, 10),
+		}},
+		{"sparse precision", []*Hll{
+			newUnionInput(r, 14, 25, 1000),
+			newUnionInput(r, 12, 20, 500),
+			newUnionInput(r, 16, 25, 10),
+		}},
+	}
+
+	for _, testCase := range testCases {
+		before := make([]*Hll, len(testCase.inputs))
+		for i, h := range testCase.inputs {
+			before[i] = h.Copy()
+		}
+
+		u, err := Union(testCase.inputs...)
+		assert.Equalf(t, nil, err, testCase.name)
+		card, err := UnionCardinality(testCase.inputs...)
+		assert.Equalf(t, nil, err, testCase.name)
+
+		for i, h := range testCase.inputs {
+			assert.Equalf(t, before[i], h.Copy(), "%s: input %d was modified", testCase.name, i)
+		}
+
+		expected := before[0].Copy()
+		for _, h := range before[1:] {
+			assert.Equal(t, nil, expected.Combine(h.Copy()))
+		}
+		assert.Equalf(t, expected.Dump(), u.Dump(), testCase.name)
+		assert.Equalf(t, expected.Cardinality(), card, testCase.name)
+	}
+}
+
+func TestUnionErrors(t *testing.T) {
+	_, err := Union()
+	assert.NotEqual(t, nil, err)
+	_, err = UnionCardinality()
+	assert.NotEqual(t, nil, err)
+
+	a, b := NewHll(14, 25), NewHll(14, 25)
+	a.SetValueType(ValueTypeInt64)
+	b.SetValueType(ValueTypeBytesOrString)
+	_, err = Union(a, NewHll(14, 25), b)
+	assert.NotEqual(t, nil, err)
+
+	a, _ = New(WithHasher(XXHash64Hasher))
+	b, _ = New(WithHasher(Murmur3Hasher))
+	_, err = UnionCardinality(a, b)
+	assert.NotEqual(t, nil, err)
+}
+
+func BenchmarkUnion(b *testing.B) {
+	r := mrand.New(mrand.NewSource(1))
+	inputs := make([]*Hll, 16)
+	for i := range inputs {
+		inputs[i] = newUnionInput(r, 14, 25, 500)
+	}
+
+	b.Run("Combine", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h := inputs[0].Copy()
+			for _, other := range inputs[1:] {
+				h.Combine(other)
+			}
+		}
+	})
+	b.Run("Union", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Union(inputs...)
+		}
+	})
+	b.Run("UnionCardinality", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			UnionCardinality(inputs...)
+		}
+	})
+}
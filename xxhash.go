@@ -0,0 +1,73 @@
+package hll
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxhash64 is XXH64 by Yann Collet, blocks are read as little endian.
+func xxhash64(b []byte, seed uint64) uint64 {
+	const (
+		prime1 uint64 = 0x9e3779b185ebca87
+		prime2 uint64 = 0xc2b2ae3d27d4eb4f
+		prime3 uint64 = 0x165667b19e3779f9
+		prime4 uint64 = 0x85ebca77c2b2ae63
+		prime5 uint64 = 0x27d4eb2f165667c5
+	)
+
+	round := func(acc, input uint64) uint64 {
+		acc += input * prime2
+		acc = bits.RotateLeft64(acc, 31)
+		return acc * prime1
+	}
+	mergeRound := func(acc, val uint64) uint64 {
+		acc ^= round(0, val)
+		return acc*prime1 + prime4
+	}
+
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := seed + prime1 + prime2
+		v2 := seed + prime2
+		v3 := seed
+		v4 := seed - prime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = round(v1, binary.LittleEndian.Uint64(b[0:]))
+			v2 = round(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = round(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = round(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = mergeRound(h, v1)
+		h = mergeRound(h, v2)
+		h = mergeRound(h, v3)
+		h = mergeRound(h, v4)
+	} else {
+		h = seed + prime5
+	}
+
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}